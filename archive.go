@@ -7,23 +7,20 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 	"time"
-
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
-const collectionName = "archives"
-
 const (
 	// StatusBuilding indicates that the server is building the archive.
 	StatusBuilding Status = iota
@@ -41,9 +38,31 @@ const (
 // Error returned when an archive does not exist.
 var ErrArchiveNotFound = errors.New("archive not found")
 
+// DigestMismatchError is returned when the content of an archive does not
+// match the digest expected by the client.
+type DigestMismatchError struct {
+	Expected string
+	Got      string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("digest mismatch: expected %s, got %s", e.Expected, e.Got)
+}
+
 // Status represents the current status of the archive.
 type Status byte
 
+// ParseStatus returns the status represented by the given string, as
+// returned by String.
+func ParseStatus(value string) (Status, error) {
+	for s := StatusBuilding; s <= StatusDestroyed; s++ {
+		if s.String() == value {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid status %q", value)
+}
+
 // String returns the string representation of the status.
 func (s Status) String() string {
 	switch s {
@@ -62,109 +81,391 @@ func (s Status) String() string {
 
 // Archive represents a git archive.
 type Archive struct {
-	ID        string `bson:"_id"`
-	Path      string
-	Status    Status
-	Log       string
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	ID     string `bson:"_id"`
+	Name   string
+	Path   string
+	Status Status
+	Log    string
+	Size   int64
+	Digest string
+	// MaxDownloads is the number of downloads left before the archive is
+	// destroyed.
+	MaxDownloads int
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	// ExpiresAt is the time after which the archive is destroyed, or zero
+	// when the archive does not expire.
+	ExpiresAt   time.Time `bson:",omitempty"`
+	DestroyedAt time.Time `bson:",omitempty"`
+	// Source is the git reference the archive is generated from, for
+	// archives generated by the server.
+	Source *GitSource `bson:",omitempty"`
+	// Owner is the instance of the server building the archive, which
+	// periodically updates Heartbeat while the archive is being built.
+	Owner     string    `bson:",omitempty"`
+	Heartbeat time.Time `bson:",omitempty"`
+	// Format is the format of the content, empty in archives created
+	// before the introduction of formats, which are all in DefaultFormat.
+	Format Format `bson:",omitempty"`
+}
+
+// format returns the format of the content of the archive.
+func (archive *Archive) format() Format {
+	if archive.Format == "" {
+		return DefaultFormat
+	}
+	return archive.Format
+}
+
+// GitSource describes the git reference an archive is generated from.
+type GitSource struct {
+	Repository string
+	Ref        string
+	Prefix     string
+	// Paths and Exclude are the pathspecs of the paths included in and
+	// excluded from the archive, relative to the root of the repository.
+	// When Strip is set, the only path is a directory that becomes the
+	// root of the archive.
+	Paths   []string `bson:",omitempty"`
+	Exclude []string `bson:",omitempty"`
+	Strip   bool     `bson:",omitempty"`
+}
+
+// ArchiveOptions are the options for the creation of archives.
+type ArchiveOptions struct {
+	// Digest is the SHA-256 digest expected for the content of the archive.
+	// When empty, the digest is not verified.
+	Digest string
+
+	// MaxDownloads is the number of times the archive may be downloaded
+	// before being destroyed. Defaults to 1.
+	MaxDownloads int
+
+	// TTL is the time after which the archive expires. When zero, the
+	// archive does not expire.
+	TTL time.Duration
+
+	// Format is the format of the archive, which is generated in this
+	// format or, for uploaded archives, is the format of the content.
+	// Defaults to DefaultFormat.
+	Format Format
+
+	// Paths, Exclude and Strip select the paths of the repository included
+	// in generated archives, as in GitSource. By default, the whole tree is
+	// included.
+	Paths   []string
+	Exclude []string
+	Strip   bool
+}
+
+func (opts ArchiveOptions) format() Format {
+	if opts.Format == "" {
+		return DefaultFormat
+	}
+	return opts.Format
+}
+
+func (opts ArchiveOptions) expiresAt(created time.Time) time.Time {
+	if opts.TTL <= 0 {
+		return time.Time{}
+	}
+	return created.Add(opts.TTL)
+}
+
+func (opts ArchiveOptions) maxDownloads() int {
+	if opts.MaxDownloads < 1 {
+		return 1
+	}
+	return opts.MaxDownloads
 }
 
-// NewArchive inserts a new archive in the database and save
-// the actual archive in background.
-func NewArchive(archiveFile io.ReadCloser, name, baseDir string) (*Archive, error) {
+// NewArchive inserts a new archive in the database and saves its content,
+// read from archiveFile, in the given store. If saving the content fails,
+// the archive is marked as failed and returned along with the error.
+func NewArchive(archiveFile io.Reader, name string, opts ArchiveOptions, store BlobStore) (*Archive, error) {
 	now := time.Now()
 	archive := Archive{
-		ID:        newID(name),
-		Status:    StatusBuilding,
-		CreatedAt: now,
-		UpdatedAt: now,
+		ID:           newID(name),
+		Name:         name,
+		Status:       StatusBuilding,
+		MaxDownloads: opts.maxDownloads(),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		ExpiresAt:    opts.expiresAt(now),
+		Owner:        instanceID,
+		Heartbeat:    now,
+		Format:       opts.format(),
 	}
 	log.Printf("[INFO] saving archive %q", archive.ID)
-	archive.Path = filepath.Join(baseDir, archive.ID+".tar.gz")
-	db, err := conn()
+	archive.Path = blobKey(store, archive.ID, archive.Format)
+	db, err := archiveStore()
 	if err != nil {
 		return nil, err
 	}
-	defer db.Close()
-	err = db.Collection(collectionName).Insert(archive)
+	err = db.Insert(archive)
 	if err != nil {
 		return nil, err
 	}
-	go archive.saveArchive(archiveFile, archive.Path)
-	return &archive, nil
+	err = archive.saveArchive(archiveFile, opts.Digest, store, db)
+	return &archive, err
 }
 
-// LegacyArchive inserts a new archive in the database and starts the generation
-// of the actual archive in background. It exists for backward compatibility
+// LegacyArchive inserts a new archive in the database and enqueues the
+// generation of the actual archive, which happens in background. It exists for backward compatibility
 // reasons, and will be removed in the future.
-func LegacyArchive(path, refid, baseDir, prefix string) (*Archive, error) {
+func LegacyArchive(path, refid, prefix string, opts ArchiveOptions, store BlobStore) (*Archive, error) {
 	now := time.Now()
 	archive := Archive{
-		ID:        newID(path),
-		Status:    StatusBuilding,
-		CreatedAt: now,
-		UpdatedAt: now,
+		ID:           newID(path),
+		Name:         path,
+		Status:       StatusBuilding,
+		MaxDownloads: opts.maxDownloads(),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		ExpiresAt:    opts.expiresAt(now),
+		Source: &GitSource{
+			Repository: path,
+			Ref:        refid,
+			Prefix:     prefix,
+			Paths:      opts.Paths,
+			Exclude:    opts.Exclude,
+			Strip:      opts.Strip,
+		},
+		Owner:     instanceID,
+		Heartbeat: now,
+		Format:    opts.format(),
 	}
 	log.Printf("[INFO] Generating archive %q for the path %q at reference %q", archive.ID, path, refid)
-	archive.Path = filepath.Join(baseDir, archive.ID+".tar.gz")
-	db, err := conn()
+	archive.Path = blobKey(store, archive.ID, archive.Format)
+	db, err := archiveStore()
 	if err != nil {
 		return nil, err
 	}
-	defer db.Close()
-	err = db.Collection(collectionName).Insert(archive)
+	err = db.Insert(archive)
 	if err != nil {
 		return nil, err
 	}
-	go archive.generate(path, refid, archive.Path, prefix)
+	err = jobQueue().Enqueue(archive, store, db)
+	if err != nil {
+		db.Delete(archive.ID)
+		return nil, err
+	}
 	return &archive, nil
 }
 
-func (archive Archive) saveArchive(archiveFile io.ReadCloser, archivePath string) {
-	db, err := conn()
+func (archive *Archive) saveArchive(archiveFile io.Reader, expectedDigest string, store BlobStore, db ArchiveStore) error {
+	defer archive.keepAlive(db)()
+	content := newDigestReader(archiveFile)
+	err := store.Put(archive.Path, content)
 	if err != nil {
-		return
+		archive.Log = fmt.Sprintf("failed to save archive: %s", err)
+	} else if digest := content.Digest(); expectedDigest != "" && digest != expectedDigest {
+		err = &DigestMismatchError{Expected: expectedDigest, Got: digest}
+		archive.Log = err.Error()
+		store.Delete(archive.Path)
+	} else if err = db.UpdateContent(archive.ID, content.Size(), content.Digest()); err != nil {
+		archive.Log = fmt.Sprintf("failed to record archive content: %s", err)
+		store.Delete(archive.Path)
 	}
-	defer db.Close()
-	status := StatusReady
-	f, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
-		status = StatusError
-		log.Printf("[ERROR] Failed to create file in %s", archivePath)
+		log.Printf("[ERROR] Failed to save archive %q: %s", archive.ID, archive.Log)
+		archive.Status = StatusError
+		archive.finish(db, store)
+		return err
 	}
-	defer f.Close()
-	defer archiveFile.Close()
-	io.Copy(f, archiveFile)
-	update := bson.M{"$set": bson.M{"status": status, "log": archive.Log, "updatedat": time.Now()}}
-	db.Collection(collectionName).UpdateId(archive.ID, update)
+	archive.Size = content.Size()
+	archive.Digest = content.Digest()
+	archive.Status = StatusReady
+	archive.UpdatedAt = time.Now()
+	return archive.finish(db, store)
 }
 
-func (archive Archive) generate(repositoryPath, refid, archivePath, prefix string) {
-	db, err := conn()
+// finish records the final status of the build of the archive, unless the
+// archive is no longer being built, as when it was destroyed during the
+// build. In that case, the content just saved is removed from the store.
+func (archive *Archive) finish(db ArchiveStore, store BlobStore) error {
+	defer notifyArchive(archive.ID)
+	ok, err := db.UpdateStatusIf(archive.ID, StatusBuilding, archive.Status, archive.Log)
+	if err != nil || ok {
+		return err
+	}
+	log.Printf("[INFO] Archive %q is no longer being built, discarding its content", archive.ID)
+	err = store.Delete(archive.Path)
+	if err == ErrBlobNotFound || os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// generate generates the content of the archive from its git source.
+func (archive Archive) generate(store BlobStore) {
+	db, err := archiveStore()
 	if err != nil {
 		return
 	}
-	defer db.Close()
 	status := StatusReady
+	prefix, refid := archive.Source.Prefix, archive.Source.Ref
 	if !strings.HasSuffix(prefix, "/") {
 		prefix += "/"
 	}
 	var buf bytes.Buffer
-	command := exec.Command(
-		"git", "archive", "--format=tar.gz",
-		"--output="+archivePath, "--prefix="+prefix, refid,
-	)
-	command.Dir = repositoryPath
-	command.Stdout = &buf
-	command.Stderr = &buf
-	if err := command.Run(); err != nil {
+	r, w := io.Pipe()
+	write := archive.archiver(prefix, refid)
+	done := make(chan error, 1)
+	go func() {
+		err := write(w, &buf)
+		w.CloseWithError(err)
+		done <- err
+	}()
+	content := newDigestReader(r)
+	err = store.Put(archive.Path, content)
+	r.Close()
+	// When the command fails, the store receives the error of the command
+	// through the pipe.
+	if cmdErr := <-done; err != nil && err != cmdErr {
+		status = StatusError
+		fmt.Fprintf(&buf, "failed to save archive: %s", err)
+		log.Printf("[ERROR] Failed to save archive %q: %s", archive.ID, err)
+	} else if cmdErr != nil {
 		status = StatusError
 		log.Printf("[ERROR] Failed to generate archive %q: %s", archive.ID, buf.String())
+	} else if err = db.UpdateContent(archive.ID, content.Size(), content.Digest()); err != nil {
+		status = StatusError
+		fmt.Fprintf(&buf, "failed to record archive content: %s", err)
+		log.Printf("[ERROR] Failed to record the content of archive %q: %s", archive.ID, err)
+		store.Delete(archive.Path)
 	}
 	archive.Log = buf.String()
-	update := bson.M{"$set": bson.M{"status": status, "log": archive.Log, "updatedat": time.Now()}}
-	db.Collection(collectionName).UpdateId(archive.ID, update)
+	archive.Status = status
+	archive.finish(db, store)
+}
+
+// archiver returns the function that writes the archive of the given
+// reference of its git source, either with git archive or, when the
+// -git-archiver flag is native, by reading the repository directly. The
+// git command is used as a fallback for repositories that can't be read.
+// Remote repositories are first fetched into their mirrors.
+func (archive *Archive) archiver(prefix, refid string) func(stdout, stderr io.Writer) error {
+	repository, format := archive.Source.Repository, archive.format()
+	if isRemoteRepository(repository) {
+		dir, commit, err := fetchMirror(repository, refid)
+		if err != nil {
+			return func(stdout, stderr io.Writer) error {
+				fmt.Fprintln(stderr, err)
+				return err
+			}
+		}
+		repository, refid = dir, commit
+	}
+	dir, paths, exclude := archive.Source.archivePaths()
+	if gitArchiver == "native" {
+		write, err := nativeArchive(repository, refid, dir, prefix, newPathFilter(paths, exclude), format)
+		if err == nil {
+			return write
+		}
+		log.Printf("[ERROR] Failed to read repository %q for archive %q, falling back to git archive: %s", repository, archive.ID, err)
+	}
+	treeish := refid
+	if dir != "" {
+		treeish += ":" + dir
+	}
+	gitFormat, compressor := format.gitFormat()
+	args := []string{"archive", "--format=" + gitFormat, "--prefix=" + prefix, treeish}
+	if len(paths) > 0 || len(exclude) > 0 {
+		args = append(args, "--")
+		if len(paths) == 0 {
+			args = append(args, ".")
+		}
+		args = append(args, paths...)
+		for _, spec := range exclude {
+			args = append(args, ":(exclude)"+spec)
+		}
+	}
+	commands := []*exec.Cmd{exec.Command("git", args...)}
+	commands[0].Dir = repository
+	if compressor != nil {
+		commands = append(commands, exec.Command(compressor[0], compressor[1:]...))
+	}
+	return func(stdout, stderr io.Writer) error {
+		return runPipeline(commands, stdout, stderr)
+	}
+}
+
+// runPipeline runs the commands connecting the output of each one to the
+// input of the next. The output of the last command is written to stdout,
+// and the errors of all of them to stderr.
+func runPipeline(commands []*exec.Cmd, stdout, stderr io.Writer) error {
+	errs := make([]bytes.Buffer, len(commands))
+	var pipes []*os.File
+	defer func() {
+		for _, f := range pipes {
+			f.Close()
+		}
+	}()
+	for i, command := range commands {
+		command.Stderr = &errs[i]
+		if i == len(commands)-1 {
+			command.Stdout = stdout
+			break
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		pipes = append(pipes, r, w)
+		command.Stdout = w
+		commands[i+1].Stdin = r
+	}
+	var err error
+	var started int
+	for _, command := range commands {
+		if err = command.Start(); err != nil {
+			break
+		}
+		started++
+	}
+	// Only the commands keep the pipes open, so each command sees the end
+	// of its input when the previous one exits.
+	for _, f := range pipes {
+		f.Close()
+	}
+	pipes = nil
+	for i, command := range commands[:started] {
+		if waitErr := command.Wait(); err == nil {
+			err = waitErr
+		}
+		stderr.Write(errs[i].Bytes())
+	}
+	return err
+}
+
+// digestReader computes the SHA-256 digest and the size of the content read
+// through it.
+type digestReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func newDigestReader(r io.Reader) *digestReader {
+	return &digestReader{r: r, hash: sha256.New()}
+}
+
+func (r *digestReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+	return n, err
+}
+
+// Digest returns the hex encoded SHA-256 digest of the content read so far.
+func (r *digestReader) Digest() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+// Size returns the number of bytes read so far.
+func (r *digestReader) Size() int64 {
+	return r.size
 }
 
 func newID(path string) string {
@@ -183,34 +484,147 @@ func newID(path string) string {
 
 // GetArchive returns an archive by its ID.
 func GetArchive(id string) (*Archive, error) {
-	db, err := conn()
+	db, err := archiveStore()
 	if err != nil {
 		return nil, err
 	}
-	defer db.Close()
-	var archive Archive
-	err = db.Collection(collectionName).FindId(id).One(&archive)
-	if err == mgo.ErrNotFound {
-		return nil, ErrArchiveNotFound
-	}
-	return &archive, nil
+	return db.Get(id)
 }
 
-// DestroyArchive removes an archive by its ID.
+// DestroyArchive removes an archive by its ID. Archives whose content is
+// already missing from the store are destroyed without errors.
 func DestroyArchive(id string) error {
-	archive, err := GetArchive(id)
+	db, err := archiveStore()
+	if err != nil {
+		return err
+	}
+	archive, err := db.Get(id)
 	if err != nil {
 		return err
 	}
-	db, err := conn()
+	err = db.UpdateStatus(id, StatusDestroyed, archive.Log)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
-	update := bson.M{"$set": bson.M{"status": StatusDestroyed, "updatedat": time.Now()}}
-	err = db.Collection(collectionName).UpdateId(id, update)
+	notifyArchive(id)
+	store, err := blobStore()
 	if err != nil {
 		return err
 	}
-	return os.Remove(archive.Path)
+	if transcodeCache {
+		for format := range formats {
+			if format != archive.format() {
+				store.Delete(variantKey(archive, format))
+			}
+		}
+	}
+	err = store.Delete(archive.Path)
+	if err == ErrBlobNotFound || os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// DestroyArchives destroys the archives with the given name, when name is
+// not empty, created before the given time, when it is not zero. Archives
+// being built are not destroyed. It returns the number of destroyed
+// archives.
+func DestroyArchives(name string, createdBefore time.Time) (int, error) {
+	db, err := archiveStore()
+	if err != nil {
+		return 0, err
+	}
+	archives, err := db.List(ArchiveQuery{
+		Status:        []Status{StatusReady, StatusError},
+		Name:          name,
+		CreatedBefore: createdBefore,
+	})
+	if err != nil {
+		return 0, err
+	}
+	var destroyed int
+	for _, archive := range archives {
+		err = DestroyArchive(archive.ID)
+		if err != nil {
+			return destroyed, err
+		}
+		destroyed++
+	}
+	return destroyed, nil
+}
+
+// ExpireArchives destroys the archives that expired before the given time,
+// returning the number of destroyed archives.
+func ExpireArchives(now time.Time) (int, error) {
+	db, err := archiveStore()
+	if err != nil {
+		return 0, err
+	}
+	archives, err := db.List(ArchiveQuery{
+		Status:        []Status{StatusReady, StatusError},
+		ExpiresBefore: now,
+	})
+	if err != nil {
+		return 0, err
+	}
+	var destroyed int
+	for _, archive := range archives {
+		err = DestroyArchive(archive.ID)
+		if err != nil {
+			return destroyed, err
+		}
+		log.Printf("[INFO] Destroyed expired archive %q", archive.ID)
+		destroyed++
+	}
+	return destroyed, nil
+}
+
+// PurgeArchives removes the records of the archives destroyed before the
+// given time, and destroys and removes the archives that failed before it,
+// returning the number of removed records.
+func PurgeArchives(before time.Time) (int, error) {
+	db, err := archiveStore()
+	if err != nil {
+		return 0, err
+	}
+	archives, err := db.List(ArchiveQuery{Status: []Status{StatusDestroyed, StatusError}})
+	if err != nil {
+		return 0, err
+	}
+	var purged int
+	for _, archive := range archives {
+		switch {
+		case archive.Status == StatusError && archive.UpdatedAt.Before(before):
+			err = DestroyArchive(archive.ID)
+		case archive.Status == StatusDestroyed && !archive.DestroyedAt.IsZero() && archive.DestroyedAt.Before(before):
+		default:
+			continue
+		}
+		if err == nil {
+			err = db.Delete(archive.ID)
+		}
+		if err != nil && err != ErrArchiveNotFound {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// reapArchives periodically destroys expired archives and, when purgeAfter
+// is positive, removes the records of archives destroyed or failed for
+// longer than purgeAfter. In MongoDB, destroyed archives are also purged by
+// a TTL index.
+func reapArchives(purgeAfter, interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := ExpireArchives(time.Now()); err != nil {
+			log.Printf("[ERROR] Failed to destroy expired archives: %s", err)
+		}
+		if purgeAfter <= 0 {
+			continue
+		}
+		if _, err := PurgeArchives(time.Now().Add(-purgeAfter)); err != nil {
+			log.Printf("[ERROR] Failed to purge destroyed archives: %s", err)
+		}
+	}
 }
@@ -6,14 +6,17 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/tsuru/commandmocker"
 	"gopkg.in/check.v1"
-	"gopkg.in/mgo.v2/bson"
 )
 
 func (Suite) TestStatus(c *check.C) {
@@ -34,47 +37,115 @@ func (Suite) TestStatus(c *check.C) {
 }
 
 func (Suite) TestNewArchive(c *check.C) {
-	archive, err := NewArchive(ioutil.NopCloser(bytes.NewBuffer([]byte("my file"))), "app_commit_uuid.tar.gz", "/tmp/")
+	archive, err := NewArchive(bytes.NewBuffer([]byte("my file")), "app_commit_uuid.tar.gz", ArchiveOptions{}, NewLocalStore(baseDir))
 	c.Assert(err, check.IsNil)
-	sess, err := conn()
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
-	c.Assert(archive.Status, check.Equals, StatusBuilding)
-	c.Assert(archive.Path, check.Equals, "/tmp/"+archive.ID+".tar.gz")
-	wait(c, 3e9, func() bool {
-		count, err := sess.Collection(collectionName).Find(bson.M{"_id": archive.ID, "status": StatusReady}).Count()
-		return err == nil && count == 1
-	})
-	err = sess.Collection(collectionName).FindId(archive.ID).One(&archive)
+	defer db.Delete(archive.ID)
+	c.Assert(archive.Status, check.Equals, StatusReady)
+	c.Assert(archive.Path, check.Equals, archive.ID+".tar.gz")
+	c.Assert(archive.Size, check.Equals, int64(7))
+	c.Assert(archive.Digest, check.Equals, "9e189ad1eb128bfd032968943f323dcf788fd6641cdc7ebddb72a3fa49aceb0f")
+	c.Assert(archive.MaxDownloads, check.Equals, 1)
+	c.Assert(archive.Name, check.Equals, "app_commit_uuid.tar.gz")
+	c.Assert(archive.ExpiresAt.IsZero(), check.Equals, true)
+	archive, err = db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Status, check.Equals, StatusReady)
+	c.Assert(archive.Size, check.Equals, int64(7))
+	c.Assert(archive.Digest, check.Equals, "9e189ad1eb128bfd032968943f323dcf788fd6641cdc7ebddb72a3fa49aceb0f")
+	content, err := ioutil.ReadFile(filepath.Join(baseDir, archive.Path))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "my file")
+}
+
+func (Suite) TestNewArchiveDigest(c *check.C) {
+	digest := "9e189ad1eb128bfd032968943f323dcf788fd6641cdc7ebddb72a3fa49aceb0f"
+	archive, err := NewArchive(bytes.NewBufferString("my file"), "app_commit_uuid.tar.gz", ArchiveOptions{Digest: digest}, NewLocalStore(baseDir))
+	c.Assert(err, check.IsNil)
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
+	defer db.Delete(archive.ID)
 	c.Assert(archive.Status, check.Equals, StatusReady)
 }
 
+func (Suite) TestNewArchiveDigestMismatch(c *check.C) {
+	digest := "6ae74cdd206208ac61982d0d9b8b3a72720a5c092b077bf71e08b46e482f14cf"
+	archive, err := NewArchive(bytes.NewBufferString("my file"), "app_commit_uuid.tar.gz", ArchiveOptions{Digest: digest}, NewLocalStore(baseDir))
+	c.Assert(err, check.DeepEquals, &DigestMismatchError{Expected: digest, Got: "9e189ad1eb128bfd032968943f323dcf788fd6641cdc7ebddb72a3fa49aceb0f"})
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	defer db.Delete(archive.ID)
+	archive, err = db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Status, check.Equals, StatusError)
+	c.Assert(archive.Log, check.Equals, "digest mismatch: expected "+digest+", got 9e189ad1eb128bfd032968943f323dcf788fd6641cdc7ebddb72a3fa49aceb0f")
+	c.Assert(archive.Digest, check.Equals, "")
+	_, err = os.Stat(filepath.Join(baseDir, archive.Path))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
 func (Suite) TestNewArchiveFailure(c *check.C) {
-	archive, err := NewArchive(ioutil.NopCloser(bytes.NewBuffer([]byte("my file"))), "app_commit_uuid.tar.gz", "/tmp/archive-server")
+	archive, err := NewArchive(bytes.NewBuffer([]byte("my file")), "app_commit_uuid.tar.gz", ArchiveOptions{}, NewLocalStore("/tmp/archive-server"))
+	c.Assert(err, check.NotNil)
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
-	sess, err := conn()
+	defer db.Delete(archive.ID)
+	c.Assert(archive.Status, check.Equals, StatusError)
+	archive, err = db.Get(archive.ID)
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
-	wait(c, 3e9, func() bool {
-		count, err := sess.Collection(collectionName).Find(bson.M{"_id": archive.ID, "status": StatusError}).Count()
-		return err == nil && count == 1
-	})
-	err = sess.Collection(collectionName).FindId(archive.ID).One(&archive)
+	c.Assert(archive.Status, check.Equals, StatusError)
+}
+
+// failingContentStore is an ArchiveStore that fails to record the content
+// of archives.
+type failingContentStore struct {
+	ArchiveStore
+}
+
+func (failingContentStore) UpdateContent(id string, size int64, digest string) error {
+	return errors.New("database is down")
+}
+
+func (Suite) TestSaveArchiveContentFailure(c *check.C) {
+	defer useIsolatedMetadata(c)()
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	archive := Archive{ID: "content failure", Path: "content-failure.tar.gz", Status: StatusBuilding}
+	c.Assert(db.Insert(archive), check.IsNil)
+	err = archive.saveArchive(strings.NewReader("my file"), "", NewLocalStore(baseDir), failingContentStore{db})
+	c.Assert(err, check.ErrorMatches, "database is down")
+	got, err := db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(got.Status, check.Equals, StatusError)
+	c.Assert(got.Log, check.Equals, "failed to record archive content: database is down")
+	_, err = os.Stat(filepath.Join(baseDir, archive.Path))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (Suite) TestNewArchiveFailureHalfway(c *check.C) {
+	upload := io.MultiReader(strings.NewReader("partial content"), failingReader{})
+	archive, err := NewArchive(upload, "app_commit_uuid.tar.gz", ArchiveOptions{}, NewLocalStore(baseDir))
+	c.Assert(err, check.ErrorMatches, "read failure")
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	defer db.Delete(archive.ID)
+	archive, err = db.Get(archive.ID)
 	c.Assert(err, check.IsNil)
 	c.Assert(archive.Status, check.Equals, StatusError)
+	c.Assert(archive.Log, check.Equals, "failed to save archive: read failure")
+	c.Assert(archive.Size, check.Equals, int64(0))
+	_, err = os.Stat(filepath.Join(baseDir, archive.Path))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
 }
 
 func (Suite) TestGetArchive(c *check.C) {
 	id := "some interesting id"
 	archive := Archive{ID: id, Path: "/tmp/archive.tar.gz", Status: StatusBuilding}
-	sess, err := conn()
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	sess.Collection(collectionName).Insert(archive)
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
 	gotArchive, err := GetArchive(archive.ID)
 	c.Assert(err, check.IsNil)
 	c.Assert(*gotArchive, check.DeepEquals, archive)
@@ -85,29 +156,77 @@ func (Suite) TestLegacyArchive(c *check.C) {
 	c.Assert(err, check.IsNil)
 	defer commandmocker.Remove(tmpdir)
 	path, _ := filepath.Abs("testdata/test.git")
-	archive, err := LegacyArchive(path, "e101294022323", "/tmp/archive-server", "sproject")
+	archive, err := LegacyArchive(path, "e101294022323", "sproject", ArchiveOptions{}, NewLocalStore(baseDir))
 	c.Assert(err, check.IsNil)
-	sess, err := conn()
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
+	defer db.Delete(archive.ID)
 	c.Assert(archive.Status, check.Equals, StatusBuilding)
-	c.Assert(archive.Path, check.Equals, "/tmp/archive-server/"+archive.ID+".tar.gz")
+	c.Assert(archive.Path, check.Equals, archive.ID+".tar.gz")
+	c.Assert(archive.Name, check.Equals, path)
 	wait(c, 3e9, func() bool {
-		count, err := sess.Collection(collectionName).Find(bson.M{"_id": archive.ID, "status": StatusReady}).Count()
-		return err == nil && count == 1
+		got, err := db.Get(archive.ID)
+		return err == nil && got.Status == StatusReady
 	})
 	c.Assert(commandmocker.Ran(tmpdir), check.Equals, true)
 	expected := []string{
 		"archive", "--format=tar.gz",
-		"--output=/tmp/archive-server/" + archive.ID + ".tar.gz",
 		"--prefix=sproject/", "e101294022323",
 	}
 	c.Assert(commandmocker.Parameters(tmpdir), check.DeepEquals, expected)
-	err = sess.Collection(collectionName).FindId(archive.ID).One(&archive)
+	archive, err = db.Get(archive.ID)
 	c.Assert(err, check.IsNil)
 	c.Assert(archive.Status, check.Equals, StatusReady)
-	c.Assert(archive.Log, check.Equals, "success")
+	content, err := ioutil.ReadFile(filepath.Join(baseDir, archive.Path))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "success")
+	c.Assert(archive.Size, check.Equals, int64(7))
+	c.Assert(archive.Digest, check.Equals, "aee408847d35e44e99430f0979c3357b85fe8dbb4535a494301198adbee85f27")
+}
+
+func (Suite) TestLegacyArchiveFormat(c *check.C) {
+	tmpdir, err := commandmocker.Add("git", "success")
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(tmpdir)
+	path, _ := filepath.Abs("testdata/test.git")
+	archive, err := LegacyArchive(path, "e101294022323", "sproject", ArchiveOptions{Format: FormatZip}, NewLocalStore(baseDir))
+	c.Assert(err, check.IsNil)
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	defer db.Delete(archive.ID)
+	c.Assert(archive.Format, check.Equals, FormatZip)
+	c.Assert(archive.Path, check.Equals, archive.ID+".zip")
+	wait(c, 3e9, func() bool {
+		got, err := db.Get(archive.ID)
+		return err == nil && got.Status == StatusReady
+	})
+	expected := []string{
+		"archive", "--format=zip",
+		"--prefix=sproject/", "e101294022323",
+	}
+	c.Assert(commandmocker.Parameters(tmpdir), check.DeepEquals, expected)
+}
+
+func (Suite) TestRunPipeline(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	commands := []*exec.Cmd{
+		exec.Command("echo", "-n", "hello world"),
+		exec.Command("tr", "a-z", "A-Z"),
+		exec.Command("rev"),
+	}
+	err := runPipeline(commands, &stdout, &stderr)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "DLROW OLLEH")
+	stdout.Reset()
+	commands = []*exec.Cmd{
+		exec.Command("echo", "-n", "hello world"),
+		exec.Command("sh", "-c", "cat >/dev/null; echo failed >&2; exit 1"),
+		exec.Command("cat"),
+	}
+	err = runPipeline(commands, &stdout, &stderr)
+	c.Assert(err, check.NotNil)
+	c.Assert(stdout.String(), check.Equals, "")
+	c.Assert(stderr.String(), check.Equals, "failed\n")
 }
 
 func (Suite) TestLegacyArchiveFailure(c *check.C) {
@@ -115,23 +234,41 @@ func (Suite) TestLegacyArchiveFailure(c *check.C) {
 	c.Assert(err, check.IsNil)
 	defer commandmocker.Remove(tmpdir)
 	path, _ := filepath.Abs("testdata/test.git")
-	archive, err := LegacyArchive(path, "e101294022323", "/tmp/archive-server", "sproject")
+	archive, err := LegacyArchive(path, "e101294022323", "sproject", ArchiveOptions{}, NewLocalStore(baseDir))
 	c.Assert(err, check.IsNil)
-	sess, err := conn()
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
+	defer db.Delete(archive.ID)
 	wait(c, 3e9, func() bool {
-		count, err := sess.Collection(collectionName).Find(bson.M{"_id": archive.ID, "status": StatusError}).Count()
-		return err == nil && count == 1
+		got, err := db.Get(archive.ID)
+		return err == nil && got.Status == StatusError
 	})
 	c.Assert(commandmocker.Ran(tmpdir), check.Equals, true)
-	err = sess.Collection(collectionName).FindId(archive.ID).One(&archive)
+	archive, err = db.Get(archive.ID)
 	c.Assert(err, check.IsNil)
 	c.Assert(archive.Status, check.Equals, StatusError)
 	c.Assert(archive.Log, check.Equals, "failed to generate file")
 }
 
+func (Suite) TestLegacyArchiveStoreFailure(c *check.C) {
+	tmpdir, err := commandmocker.Add("git", "success")
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(tmpdir)
+	path, _ := filepath.Abs("testdata/test.git")
+	archive, err := LegacyArchive(path, "e101294022323", "sproject", ArchiveOptions{}, NewLocalStore("/tmp/archive-server"))
+	c.Assert(err, check.IsNil)
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	defer db.Delete(archive.ID)
+	wait(c, 3e9, func() bool {
+		got, err := db.Get(archive.ID)
+		return err == nil && got.Status == StatusError
+	})
+	archive, err = db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Log, check.Matches, "failed to save archive: .*no such file or directory")
+}
+
 func (Suite) TestGetArchiveNotFound(c *check.C) {
 	archive, err := GetArchive("wat")
 	c.Assert(archive, check.IsNil)
@@ -154,19 +291,18 @@ func (Suite) TestDestroyArchive(c *check.C) {
 		CreatedAt: t,
 		UpdatedAt: t,
 	}
-	sess, err := conn()
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	sess.Collection(collectionName).Insert(archive)
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
 	err = DestroyArchive(archive.ID)
 	c.Assert(err, check.IsNil)
 	_, err = os.Stat(path)
 	c.Assert(os.IsNotExist(err), check.Equals, true)
-	err = sess.Collection(collectionName).FindId(archive.ID).One(&archive)
+	gotArchive, err := db.Get(archive.ID)
 	c.Assert(err, check.IsNil)
-	c.Assert(archive.Status, check.Equals, StatusDestroyed)
-	c.Assert(archive.UpdatedAt, check.Not(check.DeepEquals), t)
+	c.Assert(gotArchive.Status, check.Equals, StatusDestroyed)
+	c.Assert(gotArchive.UpdatedAt, check.Not(check.DeepEquals), t)
 }
 
 func (Suite) TestDestroyArchiveNotFound(c *check.C) {
@@ -174,16 +310,122 @@ func (Suite) TestDestroyArchiveNotFound(c *check.C) {
 	c.Assert(err, check.Equals, ErrArchiveNotFound)
 }
 
+func (Suite) TestDestroyArchiveMissingContent(c *check.C) {
+	archive := Archive{ID: "archive without content", Path: "missing.tar.gz", Status: StatusReady}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	err = DestroyArchive(archive.ID)
+	c.Assert(err, check.IsNil)
+	gotArchive, err := db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(gotArchive.Status, check.Equals, StatusDestroyed)
+}
+
+func (Suite) TestDestroyArchives(c *check.C) {
+	now := time.Now()
+	var tests = []struct {
+		archive  Archive
+		expected Status
+	}{
+		{Archive{ID: "old app", Name: "destroy-app.tar.gz", Status: StatusReady, CreatedAt: now.Add(-2 * time.Hour)}, StatusDestroyed},
+		{Archive{ID: "new app", Name: "destroy-app.tar.gz", Status: StatusReady, CreatedAt: now}, StatusDestroyed},
+		{Archive{ID: "old building", Name: "destroy-app.tar.gz", Status: StatusBuilding, CreatedAt: now.Add(-2 * time.Hour)}, StatusBuilding},
+		{Archive{ID: "old other", Name: "destroy-other.tar.gz", Status: StatusError, CreatedAt: now.Add(-2 * time.Hour)}, StatusError},
+	}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	for _, t := range tests {
+		t.archive.Path = t.archive.ID + ".tar.gz"
+		db.Insert(t.archive)
+		defer db.Delete(t.archive.ID)
+	}
+	destroyed, err := DestroyArchives("destroy-app.tar.gz", now.Add(-time.Hour))
+	c.Assert(err, check.IsNil)
+	c.Assert(destroyed, check.Equals, 1)
+	destroyed, err = DestroyArchives("destroy-app.tar.gz", time.Time{})
+	c.Assert(err, check.IsNil)
+	c.Assert(destroyed, check.Equals, 1)
+	for _, t := range tests {
+		gotArchive, err := db.Get(t.archive.ID)
+		c.Assert(err, check.IsNil)
+		c.Check(gotArchive.Status, check.Equals, t.expected, check.Commentf(t.archive.ID))
+	}
+}
+
+func (Suite) TestExpireArchives(c *check.C) {
+	now := time.Now()
+	var tests = []struct {
+		archive  Archive
+		expected Status
+	}{
+		{Archive{ID: "expired", Status: StatusReady, ExpiresAt: now.Add(-time.Minute)}, StatusDestroyed},
+		{Archive{ID: "expired with error", Status: StatusError, ExpiresAt: now.Add(-time.Minute)}, StatusDestroyed},
+		{Archive{ID: "expired while building", Status: StatusBuilding, ExpiresAt: now.Add(-time.Minute)}, StatusBuilding},
+		{Archive{ID: "not expired", Status: StatusReady, ExpiresAt: now.Add(time.Minute)}, StatusReady},
+		{Archive{ID: "never expires", Status: StatusReady}, StatusReady},
+	}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	for _, t := range tests {
+		t.archive.Path = t.archive.ID + ".tar.gz"
+		db.Insert(t.archive)
+		defer db.Delete(t.archive.ID)
+	}
+	destroyed, err := ExpireArchives(now)
+	c.Assert(err, check.IsNil)
+	c.Assert(destroyed, check.Equals, 2)
+	for _, t := range tests {
+		gotArchive, err := db.Get(t.archive.ID)
+		c.Assert(err, check.IsNil)
+		c.Check(gotArchive.Status, check.Equals, t.expected, check.Commentf(t.archive.ID))
+	}
+}
+
+func (Suite) TestPurgeArchives(c *check.C) {
+	defer useIsolatedMetadata(c)()
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	old := Archive{ID: "destroyed long ago", Status: StatusDestroyed, DestroyedAt: time.Now().Add(-time.Hour)}
+	db.Insert(old)
+	recent := Archive{ID: "recently destroyed", Path: "recent.tar.gz", Status: StatusReady}
+	db.Insert(recent)
+	err = DestroyArchive(recent.ID)
+	c.Assert(err, check.IsNil)
+	failed := Archive{ID: "failed long ago", Path: "failed.tar.gz", Status: StatusError, UpdatedAt: time.Now().Add(-time.Hour)}
+	db.Insert(failed)
+	store := NewLocalStore(baseDir)
+	err = store.Put(failed.Path, strings.NewReader("partial content"))
+	c.Assert(err, check.IsNil)
+	recentFailure := Archive{ID: "recently failed", Status: StatusError, UpdatedAt: time.Now()}
+	db.Insert(recentFailure)
+	purged, err := PurgeArchives(time.Now().Add(-time.Minute))
+	c.Assert(err, check.IsNil)
+	c.Assert(purged, check.Equals, 2)
+	_, err = db.Get(old.ID)
+	c.Assert(err, check.Equals, ErrArchiveNotFound)
+	_, err = db.Get(failed.ID)
+	c.Assert(err, check.Equals, ErrArchiveNotFound)
+	_, err = store.Stat(failed.Path)
+	c.Assert(err, check.Equals, ErrBlobNotFound)
+	gotArchive, err := db.Get(recent.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(gotArchive.DestroyedAt.IsZero(), check.Equals, false)
+	gotArchive, err = db.Get(recentFailure.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(gotArchive.Status, check.Equals, StatusError)
+}
+
 func (Suite) TestDestroyArchiveDBError(c *check.C) {
 	archive := Archive{ID: "hello hello"}
-	sess, err := conn()
-	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	sess.Collection(collectionName).Insert(archive)
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
-	oldDbAddr := databaseAddr
-	databaseAddr = "256.256.256.256:27017"
-	defer func() { databaseAddr = oldDbAddr }()
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	oldBackend, oldDbAddr := metadataBackend, databaseAddr
+	metadataBackend, databaseAddr = "mongodb", "256.256.256.256:27017"
+	defer func() { metadataBackend, databaseAddr = oldBackend, oldDbAddr }()
 	err = DestroyArchive(archive.ID)
 	c.Assert(err, check.NotNil)
 }
@@ -210,3 +452,43 @@ func wait(c *check.C, timeout time.Duration, fn func() bool) {
 		c.Fatalf("Timed out after %s", timeout)
 	}
 }
+
+func (Suite) TestLegacyArchivePaths(c *check.C) {
+	tmpdir, err := commandmocker.Add("git", "success")
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(tmpdir)
+	path, _ := filepath.Abs("testdata/test.git")
+	opts := ArchiveOptions{Paths: []string{"services/api"}, Exclude: []string{"services/api/test", "docs"}}
+	archive, err := LegacyArchive(path, "e101294022323", "sproject", opts, NewLocalStore(baseDir))
+	c.Assert(err, check.IsNil)
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	defer db.Delete(archive.ID)
+	c.Assert(archive.Source.Paths, check.DeepEquals, opts.Paths)
+	c.Assert(archive.Source.Exclude, check.DeepEquals, opts.Exclude)
+	wait(c, 3e9, func() bool {
+		got, err := db.Get(archive.ID)
+		return err == nil && got.Status == StatusReady
+	})
+	expected := []string{
+		"archive", "--format=tar.gz",
+		"--prefix=sproject/", "e101294022323", "--",
+		"services/api", ":(exclude)services/api/test", ":(exclude)docs",
+	}
+	c.Assert(commandmocker.Parameters(tmpdir), check.DeepEquals, expected)
+	opts.Strip = true
+	archive, err = LegacyArchive(path, "e101294022323", "sproject", opts, NewLocalStore(baseDir))
+	c.Assert(err, check.IsNil)
+	defer db.Delete(archive.ID)
+	wait(c, 3e9, func() bool {
+		got, err := db.Get(archive.ID)
+		return err == nil && got.Status == StatusReady
+	})
+	expected = []string{
+		"archive", "--format=tar.gz",
+		"--prefix=sproject/", "e101294022323:services/api", "--",
+		".", ":(exclude)test",
+	}
+	params := commandmocker.Parameters(tmpdir)
+	c.Assert(params[len(params)-len(expected):], check.DeepEquals, expected)
+}
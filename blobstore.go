@@ -0,0 +1,146 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Error returned when a blob does not exist in the store.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobInfo describes a blob stored in a BlobStore.
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Blob is the content of a blob, opened for reading. Blobs are seekable, so
+// they can be served in ranges.
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// BlobStore stores the contents of archives. Blobs are identified by a key,
+// which is the value stored in the Path field of the archive.
+type BlobStore interface {
+	// Put stores the content read from r in the given key, replacing any
+	// previous content.
+	Put(key string, r io.Reader) error
+
+	// Get opens the content stored in the given key. The caller must close
+	// the returned blob.
+	Get(key string) (Blob, error)
+
+	// Delete removes the content stored in the given key.
+	Delete(key string) error
+
+	// Stat returns information about the content stored in the given key.
+	Stat(key string) (BlobInfo, error)
+}
+
+// blobKey returns the key of the blob of a new archive: the ID of the
+// archive with the extension of its format or, in GridFS, just the ID.
+func blobKey(store BlobStore, id string, format Format) string {
+	if _, ok := store.(*GridFSStore); ok {
+		return id
+	}
+	return id + format.Extension()
+}
+
+// BlobLister is implemented by the stores that are able to list their blobs.
+type BlobLister interface {
+	// List returns information about all the blobs in the store.
+	List() ([]BlobInfo, error)
+}
+
+// LocalStore is a BlobStore that keeps blobs as files in a directory of the
+// local filesystem.
+type LocalStore struct {
+	dir string
+}
+
+// NewLocalStore returns a LocalStore that stores blobs in dir. The directory
+// must exist.
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{dir: dir}
+}
+
+// path returns the path of the file for the given key. Absolute keys are
+// used as is, for compatibility with archives created before the
+// introduction of blob stores.
+func (s *LocalStore) path(key string) string {
+	if filepath.IsAbs(key) {
+		return key
+	}
+	return filepath.Join(s.dir, key)
+}
+
+// Put writes the content to a temporary file in the same directory, which
+// is synced and renamed to the final path only after the whole content has
+// been written, so readers never see partial content.
+func (s *LocalStore) Put(key string, r io.Reader) error {
+	path := s.path(key)
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalStore) Get(key string) (Blob, error) {
+	return os.Open(s.path(key))
+}
+
+func (s *LocalStore) Delete(key string) error {
+	return os.Remove(s.path(key))
+}
+
+func (s *LocalStore) Stat(key string) (BlobInfo, error) {
+	fi, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// List returns the regular files in the directory of the store.
+func (s *LocalStore) List() ([]BlobInfo, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []BlobInfo
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			blobs = append(blobs, BlobInfo{Key: entry.Name(), Size: entry.Size(), ModTime: entry.ModTime()})
+		}
+	}
+	return blobs, nil
+}
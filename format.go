@@ -0,0 +1,133 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Format is the format of the content of an archive.
+type Format string
+
+const (
+	FormatTar    Format = "tar"
+	FormatTarGz  Format = "tar.gz"
+	FormatTarBz2 Format = "tar.bz2"
+	FormatTarXz  Format = "tar.xz"
+	FormatTarZst Format = "tar.zst"
+	FormatZip    Format = "zip"
+)
+
+// DefaultFormat is the format of archives created without a format, and of
+// the archives created before the introduction of formats.
+const DefaultFormat = FormatTarGz
+
+type formatInfo struct {
+	contentType string
+	// compressor is the command that compresses the tar generated by git,
+	// for the formats that git does not support, and decompressor is the
+	// command that reverses it, for the formats that the standard library
+	// can't read.
+	compressor   []string
+	decompressor []string
+}
+
+var formats = map[Format]formatInfo{
+	FormatTar:    {contentType: "application/x-tar"},
+	FormatTarGz:  {contentType: "application/x-gzip"},
+	FormatTarBz2: {contentType: "application/x-bzip2", compressor: []string{"bzip2", "-c"}},
+	FormatTarXz:  {contentType: "application/x-xz", compressor: []string{"xz", "-c"}, decompressor: []string{"xz", "-dc"}},
+	FormatTarZst: {contentType: "application/zstd", compressor: []string{"zstd", "-c", "-q"}, decompressor: []string{"zstd", "-dc", "-q"}},
+	FormatZip:    {contentType: "application/zip"},
+}
+
+var formatAliases = map[string]Format{
+	"tgz":      FormatTarGz,
+	"tbz2":     FormatTarBz2,
+	"txz":      FormatTarXz,
+	"tar.zstd": FormatTarZst,
+}
+
+// ParseFormat returns the format with the given name, which may also be a
+// common alias, like tgz.
+func ParseFormat(name string) (Format, error) {
+	name = strings.ToLower(name)
+	if format, ok := formatAliases[name]; ok {
+		return format, nil
+	}
+	if _, ok := formats[Format(name)]; !ok {
+		return "", fmt.Errorf("unsupported format %q", name)
+	}
+	return Format(name), nil
+}
+
+// formatOfContentType returns the format whose content is sent with the
+// given content type.
+func formatOfContentType(contentType string) (Format, bool) {
+	if contentType == "application/gzip" {
+		return FormatTarGz, true
+	}
+	for format, info := range formats {
+		if info.contentType == contentType {
+			return format, true
+		}
+	}
+	return "", false
+}
+
+// Extension returns the file extension of the format, including the dot.
+func (f Format) Extension() string {
+	return "." + string(f)
+}
+
+// ContentType returns the media type of the content of the format.
+func (f Format) ContentType() string {
+	return formats[f].contentType
+}
+
+// gitFormat returns the format passed to git archive, which is piped to the
+// compressor of the format when git does not support it.
+func (f Format) gitFormat() (string, []string) {
+	info := formats[f]
+	if info.compressor != nil {
+		return string(FormatTar), info.compressor
+	}
+	return string(f), nil
+}
+
+// checkGeneration returns an error when archives can't be generated in the
+// format, because its compressor is not installed.
+func (f Format) checkGeneration() error {
+	return checkCommands(f, formats[f].compressor)
+}
+
+// checkTranscode returns an error when archives can't be converted from one
+// format to the other, because a command needed is not installed.
+func checkTranscode(from, to Format) error {
+	if from == to {
+		return nil
+	}
+	if err := checkCommands(from, formats[from].decompressor); err != nil {
+		return err
+	}
+	return checkCommands(to, formats[to].compressor)
+}
+
+// checkCommands returns an error naming the first of the commands that is
+// not installed, so requests that need it are rejected upfront instead of
+// failing while the archive is built or sent.
+func checkCommands(format Format, commands ...[]string) error {
+	for _, args := range commands {
+		if len(args) == 0 {
+			continue
+		}
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return fmt.Errorf("archives in %s are not supported: the %s command is not installed", format, args[0])
+		}
+	}
+	return nil
+}
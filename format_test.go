@@ -0,0 +1,73 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+func (Suite) TestParseFormat(c *check.C) {
+	var tests = []struct {
+		name   string
+		format Format
+		err    string
+	}{
+		{"tar", FormatTar, ""},
+		{"tar.gz", FormatTarGz, ""},
+		{"TGZ", FormatTarGz, ""},
+		{"tar.bz2", FormatTarBz2, ""},
+		{"txz", FormatTarXz, ""},
+		{"tar.zstd", FormatTarZst, ""},
+		{"zip", FormatZip, ""},
+		{"rar", "", `unsupported format "rar"`},
+		{"", "", `unsupported format ""`},
+	}
+	for _, t := range tests {
+		format, err := ParseFormat(t.name)
+		if t.err != "" {
+			c.Check(err, check.ErrorMatches, t.err)
+			continue
+		}
+		c.Check(err, check.IsNil)
+		c.Check(format, check.Equals, t.format)
+	}
+}
+
+func (Suite) TestFormat(c *check.C) {
+	c.Assert(FormatTarXz.Extension(), check.Equals, ".tar.xz")
+	c.Assert(FormatZip.ContentType(), check.Equals, "application/zip")
+	gitFormat, compressor := FormatZip.gitFormat()
+	c.Assert(gitFormat, check.Equals, "zip")
+	c.Assert(compressor, check.IsNil)
+	gitFormat, compressor = FormatTarZst.gitFormat()
+	c.Assert(gitFormat, check.Equals, "tar")
+	c.Assert(compressor, check.DeepEquals, []string{"zstd", "-c", "-q"})
+	format, ok := formatOfContentType("application/gzip")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(format, check.Equals, FormatTarGz)
+	_, ok = formatOfContentType("text/plain")
+	c.Assert(ok, check.Equals, false)
+}
+
+// withoutCommands hides the commands of the formats until the returned
+// function is called.
+func withoutCommands(c *check.C) func() {
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", c.MkDir())
+	return func() { os.Setenv("PATH", path) }
+}
+
+func (Suite) TestCheckCommands(c *check.C) {
+	defer withoutCommands(c)()
+	c.Assert(FormatTarGz.checkGeneration(), check.IsNil)
+	c.Assert(FormatZip.checkGeneration(), check.IsNil)
+	c.Assert(FormatTarZst.checkGeneration(), check.ErrorMatches, "archives in tar.zst are not supported: the zstd command is not installed")
+	c.Assert(checkTranscode(FormatTarXz, FormatTarXz), check.IsNil)
+	c.Assert(checkTranscode(FormatTarBz2, FormatZip), check.IsNil)
+	c.Assert(checkTranscode(FormatTarXz, FormatTar), check.ErrorMatches, "archives in tar.xz are not supported: the xz command is not installed")
+	c.Assert(checkTranscode(FormatTarGz, FormatTarBz2), check.ErrorMatches, "archives in tar.bz2 are not supported: the bzip2 command is not installed")
+}
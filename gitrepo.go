@@ -0,0 +1,1070 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrGitObjectNotFound is returned when an object does not exist in
+	// the repository.
+	ErrGitObjectNotFound = errors.New("git object not found")
+
+	// ErrGitUnsupported is returned for repositories that can't be read
+	// without the git command, like repositories with old pack indexes.
+	ErrGitUnsupported = errors.New("unsupported git repository")
+
+	// ErrGitObjectTooLarge is returned for objects that would have to be
+	// held in memory and are larger than gitMaxObjectSize.
+	ErrGitObjectTooLarge = errors.New("git object too large")
+
+	// gitMaxObjectSize is the size of the largest object that is read in
+	// memory: trees, commits and blobs stored as deltas. Archives with
+	// larger ones are left to git archive.
+	gitMaxObjectSize int64 = 64 << 20
+)
+
+const (
+	// gitMaxDeltaDepth is the longest chain of deltas that is followed,
+	// which is also the longest one git creates.
+	gitMaxDeltaDepth = 4095
+
+	// gitCacheSize is the total size of the delta bases kept by each pack.
+	gitCacheSize = 16 << 20
+)
+
+// gitHash is the SHA-1 name of a git object.
+type gitHash [20]byte
+
+func parseGitHash(s string) (gitHash, bool) {
+	var h gitHash
+	if len(s) != 2*len(h) {
+		return h, false
+	}
+	_, err := hex.Decode(h[:], []byte(s))
+	return h, err == nil
+}
+
+func (h gitHash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+const (
+	gitCommit   = 1
+	gitTree     = 2
+	gitBlob     = 3
+	gitTag      = 4
+	gitOfsDelta = 6
+	gitRefDelta = 7
+)
+
+var gitTypes = map[string]int{"commit": gitCommit, "tree": gitTree, "blob": gitBlob, "tag": gitTag}
+
+// gitRepository reads the objects of a git repository without the git
+// command. It supports loose objects, packs with version 2 indexes and
+// alternate object directories.
+type gitRepository struct {
+	dir        string
+	objectDirs []string
+	packs      []*gitPack
+}
+
+// openGitRepository opens the repository at path, which may be a bare
+// repository or a working tree.
+func openGitRepository(path string) (*gitRepository, error) {
+	if fi, err := os.Stat(filepath.Join(path, ".git")); err == nil && fi.IsDir() {
+		path = filepath.Join(path, ".git")
+	}
+	if _, err := os.Stat(filepath.Join(path, "HEAD")); err != nil {
+		return nil, fmt.Errorf("%s is not a git repository", path)
+	}
+	// Objects are only read with SHA-1 names.
+	config, err := ioutil.ReadFile(filepath.Join(path, "config"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if format := gitConfig(config, "extensions", "objectformat"); format != "" && format != "sha1" {
+		return nil, ErrGitUnsupported
+	}
+	repo := gitRepository{dir: path}
+	err = repo.addObjectDir(filepath.Join(path, "objects"), 0)
+	if err != nil {
+		repo.Close()
+		return nil, err
+	}
+	return &repo, nil
+}
+
+// gitConfig returns the value of a variable in the given section of a git
+// configuration file, which is empty when it is not set. Section and key
+// names are case-insensitive, and subsections are not supported.
+func gitConfig(config []byte, section, key string) string {
+	var current, value string
+	for _, line := range strings.Split(string(config), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			current = strings.ToLower(strings.Trim(line, "[] \t"))
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if current == section && len(parts) == 2 && strings.ToLower(strings.TrimSpace(parts[0])) == key {
+			value = strings.ToLower(strings.Trim(strings.TrimSpace(parts[1]), `"`))
+		}
+	}
+	return value
+}
+
+func (repo *gitRepository) addObjectDir(dir string, depth int) error {
+	if depth > 5 {
+		return ErrGitUnsupported
+	}
+	repo.objectDirs = append(repo.objectDirs, dir)
+	indexes, err := filepath.Glob(filepath.Join(dir, "pack", "*.idx"))
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		pack, err := openGitPack(strings.TrimSuffix(index, ".idx"))
+		if err != nil {
+			return err
+		}
+		repo.packs = append(repo.packs, pack)
+	}
+	alternates, err := ioutil.ReadFile(filepath.Join(dir, "info", "alternates"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, alternate := range strings.Split(string(alternates), "\n") {
+		if alternate = strings.TrimSpace(alternate); alternate == "" || alternate[0] == '#' {
+			continue
+		}
+		if !filepath.IsAbs(alternate) {
+			alternate = filepath.Join(dir, alternate)
+		}
+		if err = repo.addObjectDir(alternate, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the packs of the repository.
+func (repo *gitRepository) Close() error {
+	for _, pack := range repo.packs {
+		pack.Close()
+	}
+	return nil
+}
+
+// object reads the object with the given name, returning its type and
+// content.
+func (repo *gitRepository) object(h gitHash) (int, []byte, error) {
+	return repo.objectAt(h, 0)
+}
+
+// objectAt reads an object that is the base of a chain of depth deltas.
+func (repo *gitRepository) objectAt(h gitHash, depth int) (int, []byte, error) {
+	for _, pack := range repo.packs {
+		if offset, ok := pack.find(h); ok {
+			return pack.base(offset, repo, depth)
+		}
+	}
+	kind, size, r, err := repo.openLoose(h)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer r.Close()
+	content, err := readGitObject(r, size)
+	return kind, content, err
+}
+
+// open returns the type and size of the object with the given name and a
+// reader of its content. Objects that are not stored as deltas are read as
+// they are decompressed, without holding them in memory.
+func (repo *gitRepository) open(h gitHash) (int, int64, io.ReadCloser, error) {
+	for _, pack := range repo.packs {
+		if offset, ok := pack.find(h); ok {
+			return pack.open(offset, repo)
+		}
+	}
+	return repo.openLoose(h)
+}
+
+func (repo *gitRepository) openLoose(h gitHash) (int, int64, io.ReadCloser, error) {
+	name := h.String()
+	for _, dir := range repo.objectDirs {
+		f, err := os.Open(filepath.Join(dir, name[:2], name[2:]))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		kind, size, r, err := readLooseObject(f)
+		if err != nil {
+			f.Close()
+		}
+		return kind, size, r, err
+	}
+	return 0, 0, nil, ErrGitObjectNotFound
+}
+
+// looseObject reads the content of a loose object, closing its file with
+// it.
+type looseObject struct {
+	*bufio.Reader
+	zr   io.ReadCloser
+	file *os.File
+}
+
+func (o *looseObject) Close() error {
+	o.zr.Close()
+	return o.file.Close()
+}
+
+// readLooseObject reads the header of a loose object, returning its type
+// and size and a reader of its content.
+func readLooseObject(f *os.File) (int, int64, io.ReadCloser, error) {
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	r := bufio.NewReader(zr)
+	header, err := r.ReadString(0)
+	if err != nil || len(header) > 32 {
+		zr.Close()
+		return 0, 0, nil, errors.New("invalid git object")
+	}
+	fields := strings.SplitN(strings.TrimSuffix(header, "\x00"), " ", 2)
+	kind, ok := gitTypes[fields[0]]
+	if len(fields) != 2 || !ok {
+		zr.Close()
+		return 0, 0, nil, errors.New("invalid git object")
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		zr.Close()
+		return 0, 0, nil, errors.New("invalid git object")
+	}
+	return kind, size, &looseObject{Reader: r, zr: zr, file: f}, nil
+}
+
+// readGitObject reads the content of an object of the given size, which
+// must not be larger than gitMaxObjectSize.
+func readGitObject(r io.Reader, size int64) ([]byte, error) {
+	if size > gitMaxObjectSize {
+		return nil, ErrGitObjectTooLarge
+	}
+	content := make([]byte, size)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, errors.New("invalid git object")
+	}
+	return content, nil
+}
+
+// resolve returns the name of the object referenced by ref, which may be a
+// full or abbreviated object name, or the name of a reference, looked up as
+// git rev-parse does.
+func (repo *gitRepository) resolve(ref string) (gitHash, error) {
+	if h, ok := parseGitHash(ref); ok {
+		return h, nil
+	}
+	candidates := []string{
+		ref,
+		"refs/" + ref,
+		"refs/tags/" + ref,
+		"refs/heads/" + ref,
+		"refs/remotes/" + ref,
+		"refs/remotes/" + ref + "/HEAD",
+	}
+	for _, name := range candidates {
+		h, err := repo.reference(name, 0)
+		if err == nil {
+			return h, nil
+		}
+		if err != ErrGitObjectNotFound {
+			return h, err
+		}
+	}
+	if len(ref) >= 4 && strings.Trim(ref, "0123456789abcdef") == "" {
+		return repo.abbreviated(ref)
+	}
+	return gitHash{}, fmt.Errorf("unknown revision %q", ref)
+}
+
+// reference reads the loose or packed reference with the given name,
+// following symbolic references.
+func (repo *gitRepository) reference(name string, depth int) (gitHash, error) {
+	if depth > 5 || strings.Contains(name, "..") {
+		return gitHash{}, ErrGitObjectNotFound
+	}
+	content, err := ioutil.ReadFile(filepath.Join(repo.dir, filepath.FromSlash(name)))
+	if err == nil {
+		value := strings.TrimSpace(string(content))
+		if strings.HasPrefix(value, "ref: ") {
+			return repo.reference(strings.TrimPrefix(value, "ref: "), depth+1)
+		}
+		if h, ok := parseGitHash(value); ok {
+			return h, nil
+		}
+	}
+	packed, err := ioutil.ReadFile(filepath.Join(repo.dir, "packed-refs"))
+	if err != nil {
+		return gitHash{}, ErrGitObjectNotFound
+	}
+	for _, line := range strings.Split(string(packed), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == name {
+			if h, ok := parseGitHash(fields[0]); ok {
+				return h, nil
+			}
+		}
+	}
+	return gitHash{}, ErrGitObjectNotFound
+}
+
+// abbreviated returns the only object whose name starts with prefix.
+func (repo *gitRepository) abbreviated(prefix string) (gitHash, error) {
+	matches := make(map[gitHash]bool)
+	for _, dir := range repo.objectDirs {
+		names, _ := filepath.Glob(filepath.Join(dir, prefix[:2], prefix[2:]+"*"))
+		for _, name := range names {
+			if h, ok := parseGitHash(prefix[:2] + filepath.Base(name)); ok {
+				matches[h] = true
+			}
+		}
+	}
+	for _, pack := range repo.packs {
+		for _, h := range pack.names {
+			if strings.HasPrefix(h.String(), prefix) {
+				matches[h] = true
+			}
+		}
+	}
+	if len(matches) > 1 {
+		return gitHash{}, fmt.Errorf("ambiguous revision %q", prefix)
+	}
+	for h := range matches {
+		return h, nil
+	}
+	return gitHash{}, fmt.Errorf("unknown revision %q", prefix)
+}
+
+// commit returns the commit referenced by h, peeling tags, and its tree and
+// committer time.
+func (repo *gitRepository) commit(h gitHash) (gitHash, gitHash, time.Time, error) {
+	for depth := 0; depth < 10; depth++ {
+		kind, content, err := repo.object(h)
+		if err != nil {
+			return h, gitHash{}, time.Time{}, err
+		}
+		headers := objectHeaders(content)
+		switch kind {
+		case gitTag:
+			var ok bool
+			if h, ok = parseGitHash(headers["object"]); !ok {
+				return h, gitHash{}, time.Time{}, errors.New("invalid git tag")
+			}
+			continue
+		case gitCommit:
+			tree, ok := parseGitHash(headers["tree"])
+			if !ok {
+				return h, gitHash{}, time.Time{}, errors.New("invalid git commit")
+			}
+			var mtime time.Time
+			if fields := strings.Fields(headers["committer"]); len(fields) >= 2 {
+				if seconds, err := strconv.ParseInt(fields[len(fields)-2], 10, 64); err == nil {
+					mtime = time.Unix(seconds, 0)
+				}
+			}
+			return h, tree, mtime, nil
+		}
+		return h, gitHash{}, time.Time{}, fmt.Errorf("%s is not a commit", h)
+	}
+	return h, gitHash{}, time.Time{}, errors.New("too many nested git tags")
+}
+
+// objectHeaders returns the headers of a commit or tag, which precede the
+// first empty line.
+func objectHeaders(content []byte) map[string]string {
+	headers := make(map[string]string)
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if _, ok := headers[parts[0]]; len(parts) == 2 && !ok {
+			headers[parts[0]] = parts[1]
+		}
+	}
+	return headers
+}
+
+type gitTreeEntry struct {
+	mode uint32
+	name string
+	hash gitHash
+}
+
+func (repo *gitRepository) tree(h gitHash) ([]gitTreeEntry, error) {
+	kind, content, err := repo.object(h)
+	if err != nil {
+		return nil, err
+	}
+	if kind != gitTree {
+		return nil, fmt.Errorf("%s is not a tree", h)
+	}
+	var entries []gitTreeEntry
+	for len(content) > 0 {
+		space := bytes.IndexByte(content, ' ')
+		null := bytes.IndexByte(content, 0)
+		if space < 0 || null < space || len(content) < null+21 {
+			return nil, errors.New("invalid git tree")
+		}
+		mode, err := strconv.ParseUint(string(content[:space]), 8, 32)
+		if err != nil {
+			return nil, errors.New("invalid git tree")
+		}
+		entry := gitTreeEntry{mode: uint32(mode), name: string(content[space+1 : null])}
+		copy(entry.hash[:], content[null+1:null+21])
+		entries = append(entries, entry)
+		content = content[null+21:]
+	}
+	return entries, nil
+}
+
+// subtree returns the tree at the given directory of a tree.
+func (repo *gitRepository) subtree(tree gitHash, dir string) (gitHash, error) {
+	for _, name := range strings.Split(dir, "/") {
+		entries, err := repo.tree(tree)
+		if err != nil {
+			return tree, err
+		}
+		found := false
+		for _, entry := range entries {
+			if entry.name == name && entry.mode&0170000 == 0040000 {
+				tree, found = entry.hash, true
+				break
+			}
+		}
+		if !found {
+			return tree, fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return tree, nil
+}
+
+// writeTar writes the tree of a commit as a tar, like git archive does: the
+// commit name is recorded in a global header, files are owned by root with
+// the permissions given by the default umask of git archive, and all
+// entries have the time of the commit. Only the paths selected by the
+// filter are written.
+func (repo *gitRepository) writeTar(w io.Writer, commit, tree gitHash, mtime time.Time, prefix string, filter pathFilter) error {
+	tw := tar.NewWriter(w)
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		Name:       "pax_global_header",
+		PAXRecords: map[string]string{"comment": commit.String()},
+	})
+	if err != nil {
+		return err
+	}
+	if prefix != "" {
+		err = tw.WriteHeader(gitTarHeader(prefix, tar.TypeDir, 0775, mtime))
+		if err != nil {
+			return err
+		}
+	}
+	writer := &treeWriter{repo: repo, tw: tw, prefix: prefix, mtime: mtime, filter: filter}
+	err = writer.write(tree, "")
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func gitTarHeader(name string, typeflag byte, mode int64, mtime time.Time) *tar.Header {
+	return &tar.Header{
+		Name:     name,
+		Typeflag: typeflag,
+		Mode:     mode,
+		ModTime:  mtime,
+		Uname:    "root",
+		Gname:    "root",
+	}
+}
+
+// treeWriter writes the entries of a tree in a tar. Directories are written
+// just before their first entry, so directories without any entry selected
+// by the filter are left out, as in git archive.
+type treeWriter struct {
+	repo    *gitRepository
+	tw      *tar.Writer
+	prefix  string
+	mtime   time.Time
+	filter  pathFilter
+	pending []string
+}
+
+func (t *treeWriter) flush() error {
+	for _, dir := range t.pending {
+		err := t.tw.WriteHeader(gitTarHeader(t.prefix+dir, tar.TypeDir, 0775, t.mtime))
+		if err != nil {
+			return err
+		}
+	}
+	t.pending = t.pending[:0]
+	return nil
+}
+
+func (t *treeWriter) write(tree gitHash, dir string) error {
+	entries, err := t.repo.tree(tree)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := dir + entry.name
+		switch entry.mode & 0170000 {
+		case 0040000:
+			if !t.filter.mayContain(name) {
+				continue
+			}
+			t.pending = append(t.pending, name+"/")
+			err = t.write(entry.hash, name+"/")
+			// When nothing was written in the directory, it is still
+			// pending, at the top of the stack.
+			if n := len(t.pending); n > 0 {
+				t.pending = t.pending[:n-1]
+			}
+		case 0160000:
+			if !t.filter.included(name) {
+				continue
+			}
+			// Submodules are archived as empty directories.
+			err = t.flush()
+			if err == nil {
+				err = t.tw.WriteHeader(gitTarHeader(t.prefix+name+"/", tar.TypeDir, 0775, t.mtime))
+			}
+		default:
+			if !t.filter.included(name) {
+				continue
+			}
+			err = t.flush()
+			if err == nil {
+				err = t.repo.writeBlob(t.tw, entry, t.prefix+name, t.mtime)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *gitRepository) writeBlob(tw *tar.Writer, entry gitTreeEntry, name string, mtime time.Time) error {
+	kind, size, r, err := repo.open(entry.hash)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if kind != gitBlob {
+		return fmt.Errorf("%s is not a blob", entry.hash)
+	}
+	if entry.mode&0170000 == 0120000 {
+		target, err := readGitObject(r, size)
+		if err != nil {
+			return err
+		}
+		hdr := gitTarHeader(name, tar.TypeSymlink, 0777, mtime)
+		hdr.Linkname = string(target)
+		return tw.WriteHeader(hdr)
+	}
+	mode := int64(0664)
+	if entry.mode&0111 != 0 {
+		mode = 0775
+	}
+	hdr := gitTarHeader(name, tar.TypeReg, mode, mtime)
+	hdr.Size = size
+	err = tw.WriteHeader(hdr)
+	if err == nil {
+		_, err = io.CopyN(tw, r, size)
+	}
+	if err == io.EOF {
+		err = errors.New("invalid git object")
+	}
+	return err
+}
+
+// checkTree returns an error, before anything is written, when the paths of
+// the tree selected by the filter can't be archived as git archive does, so
+// the archive is left to git archive: when a directory leading to them has
+// a .gitattributes file, whose attributes like export-ignore and
+// export-subst would change the archive, or when a blob is stored as a
+// delta that can't be applied in memory.
+func (repo *gitRepository) checkTree(tree gitHash, dir string, filter pathFilter) error {
+	entries, err := repo.tree(tree)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := dir + entry.name
+		if entry.name == ".gitattributes" {
+			return fmt.Errorf("%s: git attributes are not supported", name)
+		}
+		switch entry.mode & 0170000 {
+		case 0040000:
+			if filter.mayContain(name) {
+				err = repo.checkTree(entry.hash, name+"/", filter)
+			}
+		case 0160000:
+		default:
+			if !filter.included(name) {
+				continue
+			}
+			var size uint64
+			size, err = repo.deltaSize(entry.hash)
+			if err == nil && size > uint64(gitMaxObjectSize) {
+				err = fmt.Errorf("%s: %s", name, ErrGitObjectTooLarge)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAttributes returns an error when the repository has attributes in
+// info/attributes, which apply to every tree.
+func (repo *gitRepository) checkAttributes() error {
+	data, err := ioutil.ReadFile(filepath.Join(repo.dir, "info", "attributes"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && line[0] != '#' {
+			return errors.New("info/attributes: git attributes are not supported")
+		}
+	}
+	return nil
+}
+
+// deltaSize returns the memory needed to apply the delta the object is
+// stored as, which is the larger of the sizes of its base and of the
+// result, or zero when it isn't stored as a delta.
+func (repo *gitRepository) deltaSize(h gitHash) (uint64, error) {
+	for _, pack := range repo.packs {
+		offset, ok := pack.find(h)
+		if !ok {
+			continue
+		}
+		e, err := pack.entry(offset)
+		if err != nil || !e.delta() {
+			return 0, err
+		}
+		zr, err := zlib.NewReader(e.data)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		baseSize, size, err := gitDeltaSizes(bufio.NewReader(zr))
+		if baseSize > size {
+			size = baseSize
+		}
+		return size, err
+	}
+	return 0, nil
+}
+
+// nativeArchive prepares the archive of the given reference of the
+// repository at path, returning the function that writes it in the given
+// format. When dir is not empty, that directory of the tree becomes the root
+// of the archive. Errors in reading the repository and resolving the
+// reference, and blobs too large to be read, are returned before anything
+// is written.
+func nativeArchive(path, ref, dir, prefix string, filter pathFilter, format Format) (func(stdout, stderr io.Writer) error, error) {
+	repo, err := openGitRepository(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := repo.resolve(ref)
+	if err == nil {
+		var commit, tree gitHash
+		var mtime time.Time
+		commit, tree, mtime, err = repo.commit(h)
+		if err == nil && dir != "" {
+			tree, err = repo.subtree(tree, dir)
+		}
+		if err == nil {
+			err = repo.checkAttributes()
+		}
+		if err == nil {
+			err = repo.checkTree(tree, "", filter)
+		}
+		if err == nil {
+			return func(stdout, stderr io.Writer) error {
+				defer repo.Close()
+				err := writeFormat(stdout, format, func(w io.Writer) error {
+					return repo.writeTar(w, commit, tree, mtime, prefix, filter)
+				})
+				if err != nil {
+					fmt.Fprintln(stderr, err)
+				}
+				return err
+			}, nil
+		}
+	}
+	repo.Close()
+	return nil, err
+}
+
+// writeFormat writes the tar written by writeTar in the given format.
+func writeFormat(w io.Writer, format Format, writeTar func(io.Writer) error) error {
+	if format == FormatTar {
+		return writeTar(w)
+	}
+	r, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(pw))
+	}()
+	err := transcode(w, r, FormatTar, format)
+	r.CloseWithError(err)
+	return err
+}
+
+// gitPack is a pack of objects, with its version 2 index.
+type gitPack struct {
+	file    *os.File
+	names   []gitHash
+	offsets []int64
+	cache   gitObjectCache
+}
+
+func openGitPack(path string) (*gitPack, error) {
+	index, err := ioutil.ReadFile(path + ".idx")
+	if err != nil {
+		return nil, err
+	}
+	if len(index) < 8+256*4 || !bytes.Equal(index[:8], []byte{0xff, 't', 'O', 'c', 0, 0, 0, 2}) {
+		return nil, ErrGitUnsupported
+	}
+	count := int(binary.BigEndian.Uint32(index[8+255*4:]))
+	namesAt := 8 + 256*4
+	offsetsAt := namesAt + count*(20+4)
+	largeAt := offsetsAt + count*4
+	if len(index) < largeAt {
+		return nil, errors.New("invalid git pack index")
+	}
+	pack := gitPack{names: make([]gitHash, count), offsets: make([]int64, count)}
+	for i := 0; i < count; i++ {
+		copy(pack.names[i][:], index[namesAt+i*20:])
+		offset := binary.BigEndian.Uint32(index[offsetsAt+i*4:])
+		if offset&0x80000000 == 0 {
+			pack.offsets[i] = int64(offset)
+			continue
+		}
+		at := largeAt + int(offset&0x7fffffff)*8
+		if len(index) < at+8 {
+			return nil, errors.New("invalid git pack index")
+		}
+		pack.offsets[i] = int64(binary.BigEndian.Uint64(index[at:]))
+	}
+	pack.file, err = os.Open(path + ".pack")
+	if err != nil {
+		return nil, err
+	}
+	return &pack, nil
+}
+
+func (pack *gitPack) Close() error {
+	return pack.file.Close()
+}
+
+// find returns the offset of the object in the pack.
+func (pack *gitPack) find(h gitHash) (int64, bool) {
+	lo, hi := 0, len(pack.names)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		switch bytes.Compare(pack.names[mid][:], h[:]) {
+		case 0:
+			return pack.offsets[mid], true
+		case -1:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return 0, false
+}
+
+var errInvalidPackObject = errors.New("invalid git pack object")
+
+// gitPackEntry is the header of an object in a pack.
+type gitPackEntry struct {
+	kind int
+	// size is the size of the object or, for deltas, of the delta.
+	size int64
+	// base is the offset of the base of an offset delta.
+	base int64
+	// ref is the name of the base of a reference delta.
+	ref gitHash
+	// data reads the compressed content that follows the header.
+	data *bufio.Reader
+}
+
+func (e *gitPackEntry) delta() bool {
+	return e.kind == gitOfsDelta || e.kind == gitRefDelta
+}
+
+// entry reads the header of the object at the given offset of the pack.
+func (pack *gitPack) entry(offset int64) (*gitPackEntry, error) {
+	r := bufio.NewReader(io.NewSectionReader(pack.file, offset, 1<<62))
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	e := gitPackEntry{kind: int(b>>4) & 7, size: int64(b & 0x0f), data: r}
+	for shift := uint(4); b&0x80 != 0; shift += 7 {
+		if b, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+		if shift > 56 {
+			return nil, errInvalidPackObject
+		}
+		e.size |= int64(b&0x7f) << shift
+	}
+	switch e.kind {
+	case gitOfsDelta:
+		b, err = r.ReadByte()
+		distance := int64(b & 0x7f)
+		for err == nil && b&0x80 != 0 && distance < offset {
+			b, err = r.ReadByte()
+			distance = (distance+1)<<7 | int64(b&0x7f)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The base must come before the delta, which also keeps corrupt
+		// packs from sending us around in circles.
+		if distance <= 0 || distance >= offset {
+			return nil, errInvalidPackObject
+		}
+		e.base = offset - distance
+	case gitRefDelta:
+		if _, err = io.ReadFull(r, e.ref[:]); err != nil {
+			return nil, err
+		}
+	case gitCommit, gitTree, gitBlob, gitTag:
+	default:
+		return nil, errInvalidPackObject
+	}
+	return &e, nil
+}
+
+// open returns the type and size of the object at the given offset of the
+// pack and a reader of its content. Deltas are applied in memory, other
+// objects are decompressed as they are read.
+func (pack *gitPack) open(offset int64, repo *gitRepository) (int, int64, io.ReadCloser, error) {
+	e, err := pack.entry(offset)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if e.delta() {
+		kind, content, err := pack.object(offset, repo, 0)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		return kind, int64(len(content)), ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+	zr, err := zlib.NewReader(e.data)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return e.kind, e.size, zr, nil
+}
+
+// object reads the object at the given offset of the pack, applying deltas
+// on their base objects, which are looked up in repo. Depth is the number
+// of deltas already being applied on it.
+func (pack *gitPack) object(offset int64, repo *gitRepository, depth int) (int, []byte, error) {
+	e, err := pack.entry(offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !e.delta() {
+		zr, err := zlib.NewReader(e.data)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer zr.Close()
+		content, err := readGitObject(zr, e.size)
+		return e.kind, content, err
+	}
+	if depth >= gitMaxDeltaDepth {
+		return 0, nil, errors.New("git delta chain too long")
+	}
+	var kind int
+	var base []byte
+	if e.kind == gitOfsDelta {
+		kind, base, err = pack.base(e.base, repo, depth+1)
+	} else {
+		kind, base, err = repo.objectAt(e.ref, depth+1)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	zr, err := zlib.NewReader(e.data)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer zr.Close()
+	delta, err := readGitObject(zr, e.size)
+	if err != nil {
+		return 0, nil, err
+	}
+	content, err := applyGitDelta(base, delta)
+	return kind, content, err
+}
+
+// base reads the object at the given offset of the pack as the base of a
+// delta, keeping it in the cache of the pack, as objects are often the base
+// of several deltas.
+func (pack *gitPack) base(offset int64, repo *gitRepository, depth int) (int, []byte, error) {
+	if object, ok := pack.cache.objects[offset]; ok {
+		return object.kind, object.content, nil
+	}
+	kind, content, err := pack.object(offset, repo, depth)
+	if err == nil {
+		pack.cache.add(offset, kind, content)
+	}
+	return kind, content, err
+}
+
+// gitObjectCache keeps the objects last added to it, up to gitCacheSize
+// bytes.
+type gitObjectCache struct {
+	objects map[int64]gitCachedObject
+	offsets []int64
+	size    int
+}
+
+type gitCachedObject struct {
+	kind    int
+	content []byte
+}
+
+func (cache *gitObjectCache) add(offset int64, kind int, content []byte) {
+	if len(content) > gitCacheSize/4 {
+		return
+	}
+	if cache.objects == nil {
+		cache.objects = make(map[int64]gitCachedObject)
+	}
+	for cache.size+len(content) > gitCacheSize {
+		oldest := cache.offsets[0]
+		cache.offsets = cache.offsets[1:]
+		cache.size -= len(cache.objects[oldest].content)
+		delete(cache.objects, oldest)
+	}
+	cache.objects[offset] = gitCachedObject{kind: kind, content: content}
+	cache.offsets = append(cache.offsets, offset)
+	cache.size += len(content)
+}
+
+var errInvalidDelta = errors.New("invalid git delta")
+
+// gitDeltaSizes reads the sizes of the base and of the result of a delta.
+func gitDeltaSizes(r io.ByteReader) (uint64, uint64, error) {
+	baseSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, 0, errInvalidDelta
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, 0, errInvalidDelta
+	}
+	return baseSize, size, nil
+}
+
+// applyGitDelta rebuilds an object from its base and a delta, which is a
+// sequence of copies from the base and insertions of new data.
+func applyGitDelta(base, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	baseSize, size, err := gitDeltaSizes(r)
+	if err != nil || baseSize != uint64(len(base)) {
+		return nil, errInvalidDelta
+	}
+	if size > uint64(gitMaxObjectSize) {
+		return nil, ErrGitObjectTooLarge
+	}
+	result := make([]byte, 0, size)
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if op&0x80 == 0 {
+			if op == 0 {
+				return nil, errInvalidDelta
+			}
+			data := make([]byte, op)
+			if _, err = io.ReadFull(r, data); err != nil || uint64(len(result)+len(data)) > size {
+				return nil, errInvalidDelta
+			}
+			result = append(result, data...)
+			continue
+		}
+		var offset, length uint64
+		for i := uint(0); i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			}
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, errInvalidDelta
+			}
+			if i < 4 {
+				offset |= uint64(b) << (8 * i)
+			} else {
+				length |= uint64(b) << (8 * (i - 4))
+			}
+		}
+		if length == 0 {
+			length = 0x10000
+		}
+		if offset+length > uint64(len(base)) || uint64(len(result))+length > size {
+			return nil, errInvalidDelta
+		}
+		result = append(result, base[offset:offset+length]...)
+	}
+	if uint64(len(result)) != size {
+		return nil, errInvalidDelta
+	}
+	return result, nil
+}
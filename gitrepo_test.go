@@ -0,0 +1,275 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+// tarEntries describes the entries of a tar, for comparing archives.
+func tarEntries(c *check.C, r io.Reader) []string {
+	var entries []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, check.IsNil)
+		content, err := ioutil.ReadAll(tr)
+		c.Assert(err, check.IsNil)
+		entry := fmt.Sprintf("%s %c %o %d %x %s %d", hdr.Name, hdr.Typeflag, hdr.Mode, hdr.Size, sha1.Sum(content), hdr.Linkname, hdr.ModTime.Unix())
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			entry += " " + hdr.PAXRecords["comment"]
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// gitCommand runs git in dir, skipping the test when git is not available.
+func gitCommand(c *check.C, dir string, args ...string) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		c.Skip("git is not available")
+	}
+	args = append([]string{"-c", "user.name=archive-server", "-c", "user.email=archive-server@example.com"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_COMMITTER_DATE=2015-10-21T07:28:00Z", "GIT_AUTHOR_DATE=2015-10-21T07:28:00Z")
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, check.IsNil, check.Commentf("git %s: %s", strings.Join(args, " "), out))
+	return strings.TrimSpace(string(out))
+}
+
+// nativeTar returns the archive of ref generated without the git command.
+func nativeTar(c *check.C, path, ref, prefix string) []byte {
+	write, err := nativeArchive(path, ref, "", prefix, pathFilter{}, FormatTar)
+	c.Assert(err, check.IsNil)
+	var stdout, stderr bytes.Buffer
+	err = write(&stdout, &stderr)
+	c.Assert(err, check.IsNil, check.Commentf("%s", stderr.String()))
+	return stdout.Bytes()
+}
+
+func (Suite) TestNativeArchiveLooseObjects(c *check.C) {
+	path, _ := filepath.Abs("testdata/test.git")
+	expected := gitCommand(c, path, "archive", "--format=tar", "--prefix=project/", "master")
+	got := nativeTar(c, path, "master", "project/")
+	c.Assert(tarEntries(c, bytes.NewReader(got)), check.DeepEquals, tarEntries(c, strings.NewReader(expected)))
+}
+
+func (Suite) TestNativeArchivePacked(c *check.C) {
+	dir := c.MkDir()
+	work, bare := filepath.Join(dir, "work"), filepath.Join(dir, "repo.git")
+	gitCommand(c, dir, "init", "-q", work)
+	var content bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&content, "line %d of a file large enough to be stored as a delta\n", i)
+	}
+	files := map[string]string{
+		"README":        "hello world!\n",
+		"src/main.go":   content.String(),
+		"src/other.go":  content.String() + "changed\n",
+		"bin/build.sh":  "#!/bin/sh\n",
+		"docs/a/b/c.md": "deep\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(work, name)
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), check.IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte(data), 0644), check.IsNil)
+	}
+	c.Assert(os.Chmod(filepath.Join(work, "bin/build.sh"), 0755), check.IsNil)
+	c.Assert(os.Symlink("README", filepath.Join(work, "LINK")), check.IsNil)
+	gitCommand(c, work, "add", ".")
+	gitCommand(c, work, "commit", "-q", "-m", "first")
+	ioutil.WriteFile(filepath.Join(work, "src/main.go"), []byte(content.String()+"more\n"), 0644)
+	gitCommand(c, work, "commit", "-q", "-a", "-m", "second")
+	gitCommand(c, work, "tag", "-a", "-m", "release", "v1.0")
+	gitCommand(c, dir, "clone", "-q", "--bare", work, bare)
+	gitCommand(c, bare, "gc", "-q", "--aggressive")
+	loose, _ := filepath.Glob(filepath.Join(bare, "objects", "??", "*"))
+	c.Assert(loose, check.HasLen, 0)
+	head := gitCommand(c, bare, "rev-parse", "HEAD")
+	for _, ref := range []string{"HEAD", "master", "v1.0", "refs/tags/v1.0", head, head[:10]} {
+		expected := gitCommand(c, bare, "archive", "--format=tar", "--prefix=app/", ref)
+		got := nativeTar(c, bare, ref, "app/")
+		c.Check(tarEntries(c, bytes.NewReader(got)), check.DeepEquals, tarEntries(c, strings.NewReader(expected)), check.Commentf("ref %s", ref))
+	}
+	first := gitCommand(c, bare, "rev-parse", "HEAD~1")
+	expected := gitCommand(c, bare, "archive", "--format=tar", first)
+	got := nativeTar(c, bare, first, "")
+	c.Assert(tarEntries(c, bytes.NewReader(got)), check.DeepEquals, tarEntries(c, strings.NewReader(expected)))
+	_, err := nativeArchive(bare, "unknown", "", "app/", pathFilter{}, FormatTar)
+	c.Assert(err, check.ErrorMatches, `unknown revision "unknown"`)
+	_, err = nativeArchive(dir, "master", "", "app/", pathFilter{}, FormatTar)
+	c.Assert(err, check.ErrorMatches, ".* is not a git repository")
+}
+
+func (Suite) TestNativeArchiveUnsupported(c *check.C) {
+	dir := c.MkDir()
+	work, bare := filepath.Join(dir, "work"), filepath.Join(dir, "repo.git")
+	gitCommand(c, dir, "init", "-q", work)
+	c.Assert(os.MkdirAll(filepath.Join(work, "docs"), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(work, "README"), []byte("hello world!\n"), 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(work, "docs/index.md"), []byte("docs\n"), 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(work, "docs/.gitattributes"), []byte("*.md export-ignore\n"), 0644), check.IsNil)
+	gitCommand(c, work, "add", ".")
+	gitCommand(c, work, "commit", "-q", "-m", "first")
+	gitCommand(c, dir, "clone", "-q", "--bare", work, bare)
+	// Attributes only matter in the directories archived.
+	_, err := nativeArchive(bare, "master", "", "", newPathFilter([]string{"README"}, nil), FormatTar)
+	c.Assert(err, check.IsNil)
+	_, err = nativeArchive(bare, "master", "", "", pathFilter{}, FormatTar)
+	c.Assert(err, check.ErrorMatches, "docs/.gitattributes: git attributes are not supported")
+	_, err = nativeArchive(bare, "master", "", "", newPathFilter(nil, []string{"docs/.gitattributes"}), FormatTar)
+	c.Assert(err, check.ErrorMatches, "docs/.gitattributes: git attributes are not supported")
+	c.Assert(os.MkdirAll(filepath.Join(bare, "info"), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(bare, "info", "attributes"), []byte("# comment\nREADME export-subst\n"), 0644), check.IsNil)
+	_, err = nativeArchive(bare, "master", "", "", newPathFilter([]string{"README"}, nil), FormatTar)
+	c.Assert(err, check.ErrorMatches, "info/attributes: git attributes are not supported")
+	c.Assert(os.Remove(filepath.Join(bare, "info", "attributes")), check.IsNil)
+	config, err := os.OpenFile(filepath.Join(bare, "config"), os.O_WRONLY|os.O_APPEND, 0644)
+	c.Assert(err, check.IsNil)
+	_, err = config.WriteString("[extensions]\n\tobjectFormat = sha256\n")
+	config.Close()
+	c.Assert(err, check.IsNil)
+	_, err = nativeArchive(bare, "master", "", "", newPathFilter([]string{"README"}, nil), FormatTar)
+	c.Assert(err, check.Equals, ErrGitUnsupported)
+}
+
+func (Suite) TestGitConfig(c *check.C) {
+	config := []byte("[core]\n\tbare = true\n# [extensions]\n[Extensions]\n\tObjectFormat = \"SHA1\"\n")
+	c.Assert(gitConfig(config, "core", "bare"), check.Equals, "true")
+	c.Assert(gitConfig(config, "extensions", "objectformat"), check.Equals, "sha1")
+	c.Assert(gitConfig(config, "core", "objectformat"), check.Equals, "")
+}
+
+func (Suite) TestApplyGitDelta(c *check.C) {
+	base := []byte("hello world!")
+	delta := []byte{
+		12, 14, // sizes of the base and of the result
+		0x91, 6, 5, // copy "world" from offset 6
+		3, ',', ' ', 'h', // insert ", h"
+		0x90, 6, // copy "hello " from offset 0
+	}
+	result, err := applyGitDelta(base, delta)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(result), check.Equals, "world, hhello ")
+	_, err = applyGitDelta(base, []byte{11, 1, 1, 'a'})
+	c.Assert(err, check.Equals, errInvalidDelta)
+	_, err = applyGitDelta(base, []byte{12, 5, 0x91, 10, 5})
+	c.Assert(err, check.Equals, errInvalidDelta)
+	_, err = applyGitDelta(base, []byte{12, 5, 0x91, 6, 5, 0x91, 6, 5})
+	c.Assert(err, check.Equals, errInvalidDelta)
+	defer func(size int64) { gitMaxObjectSize = size }(gitMaxObjectSize)
+	gitMaxObjectSize = 10
+	_, err = applyGitDelta(base, delta)
+	c.Assert(err, check.Equals, ErrGitObjectTooLarge)
+}
+
+func (Suite) TestGitPackInvalidDeltas(c *check.C) {
+	names := []gitHash{{1}, {2}, {3}, {4}}
+	data := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x04")
+	offsets := make([]int64, len(names))
+	offsets[0] = int64(len(data))
+	data = append(data, 0x65, 0) // offset delta on itself
+	offsets[1] = int64(len(data))
+	data = append(data, 0x65, 100) // offset delta on an object after it
+	offsets[2] = int64(len(data))
+	data = append(data, 0x75) // reference delta on itself
+	data = append(data, names[2][:]...)
+	offsets[3] = int64(len(data))
+	data = append(data, 0x75) // reference delta on the first one
+	data = append(data, names[0][:]...)
+	path := filepath.Join(c.MkDir(), "pack")
+	c.Assert(ioutil.WriteFile(path, data, 0644), check.IsNil)
+	f, err := os.Open(path)
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	repo := gitRepository{packs: []*gitPack{{file: f, names: names, offsets: offsets}}}
+	_, _, err = repo.object(names[0])
+	c.Assert(err, check.Equals, errInvalidPackObject)
+	_, _, err = repo.object(names[1])
+	c.Assert(err, check.Equals, errInvalidPackObject)
+	_, _, err = repo.object(names[2])
+	c.Assert(err, check.ErrorMatches, "git delta chain too long")
+	_, _, err = repo.object(names[3])
+	c.Assert(err, check.Equals, errInvalidPackObject)
+	_, _, _, err = repo.open(names[2])
+	c.Assert(err, check.ErrorMatches, "git delta chain too long")
+}
+
+func (Suite) TestNativeArchiveLargeObjects(c *check.C) {
+	dir := c.MkDir()
+	work, bare := filepath.Join(dir, "work"), filepath.Join(dir, "repo.git")
+	gitCommand(c, dir, "init", "-q", work)
+	var big, content bytes.Buffer
+	for i := 0; i < 4000; i++ {
+		fmt.Fprintf(&big, "%x\n", sha1.Sum([]byte(fmt.Sprint(i))))
+		fmt.Fprintf(&content, "line %d of a file large enough to be stored as a delta\n", i)
+	}
+	files := map[string]string{
+		"big":         big.String(),
+		"src/main.go": content.String(),
+		"src/old.go":  content.String() + "changed\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(work, name)
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), check.IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte(data), 0644), check.IsNil)
+	}
+	gitCommand(c, work, "add", ".")
+	gitCommand(c, work, "commit", "-q", "-m", "first")
+	gitCommand(c, dir, "clone", "-q", "--bare", work, bare)
+	gitCommand(c, bare, "gc", "-q", "--aggressive")
+	defer func(size int64) { gitMaxObjectSize = size }(gitMaxObjectSize)
+	gitMaxObjectSize = 64 << 10
+	// Blobs that are not deltas are streamed, whatever their size.
+	write, err := nativeArchive(bare, "master", "", "", newPathFilter([]string{"big"}, nil), FormatTar)
+	c.Assert(err, check.IsNil)
+	var stdout, stderr bytes.Buffer
+	c.Assert(write(&stdout, &stderr), check.IsNil, check.Commentf("%s", stderr.String()))
+	expected := gitCommand(c, bare, "archive", "--format=tar", "master", "big")
+	c.Assert(tarEntries(c, &stdout), check.DeepEquals, tarEntries(c, strings.NewReader(expected)))
+	_, err = nativeArchive(bare, "master", "", "", pathFilter{}, FormatTar)
+	c.Assert(err, check.ErrorMatches, `src/(main|old)\.go: git object too large`)
+}
+
+func (Suite) TestLegacyArchiveNative(c *check.C) {
+	gitArchiver = "native"
+	defer func() { gitArchiver = "command" }()
+	path, _ := filepath.Abs("testdata/test.git")
+	archive, err := LegacyArchive(path, "master", "project", ArchiveOptions{}, NewLocalStore(baseDir))
+	c.Assert(err, check.IsNil)
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	defer db.Delete(archive.ID)
+	defer os.Remove(filepath.Join(baseDir, archive.Path))
+	wait(c, 3e9, func() bool {
+		got, err := db.Get(archive.ID)
+		return err == nil && got.Status == StatusReady
+	})
+	f, err := os.Open(filepath.Join(baseDir, archive.Path))
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	c.Assert(err, check.IsNil)
+	entries := tarEntries(c, gz)
+	c.Assert(entries, check.HasLen, 3)
+	c.Assert(entries[1], check.Matches, "project/ 5 775 .*")
+	c.Assert(entries[2], check.Matches, "project/README 0 664 0 .*")
+}
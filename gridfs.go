@@ -0,0 +1,176 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/tsuru/tsuru/db/storage"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GridFSStore is a BlobStore that keeps blobs in a GridFS bucket of the
+// MongoDB database, so any instance of the server connected to the same
+// database is able to serve any archive. The key of the blob is used as the
+// ID of the GridFS file, and the blob of an archive is keyed by the ID of the
+// archive (see blobKey). Archives stored before that keep the key recorded
+// in their Path.
+type GridFSStore struct {
+	prefix string
+}
+
+// NewGridFSStore returns a GridFSStore that uses the GridFS bucket with the
+// given prefix.
+func NewGridFSStore(prefix string) *GridFSStore {
+	return &GridFSStore{prefix: prefix}
+}
+
+func (s *GridFSStore) gridFS(db *storage.Storage) *mgo.GridFS {
+	return db.Collection(s.prefix + ".files").Database.GridFS(s.prefix)
+}
+
+func (s *GridFSStore) Put(key string, r io.Reader) error {
+	db, err := conn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	gfs := s.gridFS(db)
+	// Like LocalStore, the content is written to a dot-prefixed temporary
+	// file, which only gets the key once it is complete.
+	tmp := "." + key + "." + bson.NewObjectId().Hex()
+	file, err := gfs.Create(key)
+	if err != nil {
+		return err
+	}
+	file.SetId(tmp)
+	_, err = io.Copy(file, r)
+	if err != nil {
+		file.Abort()
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	err = s.rename(gfs, tmp, key)
+	if err != nil {
+		gfs.RemoveId(tmp)
+	}
+	return err
+}
+
+// rename gives the complete file with the ID tmp the ID key, replacing the
+// file with that ID. The chunks are moved before the file itself is
+// inserted, so the file is never found with only part of its content.
+func (s *GridFSStore) rename(gfs *mgo.GridFS, tmp, key string) error {
+	var doc bson.M
+	err := gfs.Files.FindId(tmp).One(&doc)
+	if err != nil {
+		return err
+	}
+	err = gfs.Files.RemoveId(key)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	// Chunks of the key are removed even without the file, as they may
+	// have been left by an interrupted write.
+	_, err = gfs.Chunks.RemoveAll(bson.M{"files_id": key})
+	if err == nil {
+		_, err = gfs.Chunks.UpdateAll(bson.M{"files_id": tmp}, bson.M{"$set": bson.M{"files_id": key}})
+	}
+	if err == nil {
+		doc["_id"] = key
+		err = gfs.Files.Insert(doc)
+	}
+	if err == nil {
+		err = gfs.Files.RemoveId(tmp)
+	}
+	return err
+}
+
+func (s *GridFSStore) Get(key string) (Blob, error) {
+	db, err := conn()
+	if err != nil {
+		return nil, err
+	}
+	file, err := s.gridFS(db).OpenId(key)
+	if err != nil {
+		db.Close()
+		if err == mgo.ErrNotFound {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	return &gridFSFile{GridFile: file, db: db}, nil
+}
+
+func (s *GridFSStore) Delete(key string) error {
+	db, err := conn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = s.gridFS(db).RemoveId(key)
+	if err == mgo.ErrNotFound {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (s *GridFSStore) Stat(key string) (BlobInfo, error) {
+	db, err := conn()
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	defer db.Close()
+	file, err := s.gridFS(db).OpenId(key)
+	if err == mgo.ErrNotFound {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	defer file.Close()
+	return BlobInfo{Key: key, Size: file.Size(), ModTime: file.UploadDate()}, nil
+}
+
+func (s *GridFSStore) List() ([]BlobInfo, error) {
+	db, err := conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var files []struct {
+		ID         interface{} `bson:"_id"`
+		Length     int64
+		UploadDate time.Time `bson:"uploadDate"`
+	}
+	err = s.gridFS(db).Find(nil).All(&files)
+	if err != nil {
+		return nil, err
+	}
+	blobs := make([]BlobInfo, 0, len(files))
+	for _, file := range files {
+		if key, ok := file.ID.(string); ok {
+			blobs = append(blobs, BlobInfo{Key: key, Size: file.Length, ModTime: file.UploadDate})
+		}
+	}
+	return blobs, nil
+}
+
+// gridFSFile is a GridFS file opened for reading, that holds the connection
+// to the database until it is closed.
+type gridFSFile struct {
+	*mgo.GridFile
+	db *storage.Storage
+}
+
+func (f *gridFSFile) Close() error {
+	defer f.db.Close()
+	return f.GridFile.Close()
+}
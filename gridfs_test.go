@@ -0,0 +1,98 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (MongoSuite) TestGridFSStore(c *check.C) {
+	store := NewGridFSStore("archives_test")
+	err := store.Put("gridfs-store.tar.gz", strings.NewReader("old content"))
+	c.Assert(err, check.IsNil)
+	err = store.Put("gridfs-store.tar.gz", strings.NewReader("some content"))
+	c.Assert(err, check.IsNil)
+	info, err := store.Stat("gridfs-store.tar.gz")
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Key, check.Equals, "gridfs-store.tar.gz")
+	c.Assert(info.Size, check.Equals, int64(12))
+	file, err := store.Get("gridfs-store.tar.gz")
+	c.Assert(err, check.IsNil)
+	content, err := ioutil.ReadAll(file)
+	c.Assert(err, check.IsNil)
+	c.Assert(file.Close(), check.IsNil)
+	c.Assert(string(content), check.Equals, "some content")
+	err = store.Delete("gridfs-store.tar.gz")
+	c.Assert(err, check.IsNil)
+	_, err = store.Get("gridfs-store.tar.gz")
+	c.Assert(err, check.Equals, ErrBlobNotFound)
+	_, err = store.Stat("gridfs-store.tar.gz")
+	c.Assert(err, check.Equals, ErrBlobNotFound)
+	err = store.Delete("gridfs-store.tar.gz")
+	c.Assert(err, check.Equals, ErrBlobNotFound)
+}
+
+func (MongoSuite) TestGridFSStorePutFailure(c *check.C) {
+	store := NewGridFSStore("archives_test")
+	err := store.Put("gridfs-failure.tar.gz", failingReader{})
+	c.Assert(err, check.ErrorMatches, "read failure")
+	_, err = store.Stat("gridfs-failure.tar.gz")
+	c.Assert(err, check.Equals, ErrBlobNotFound)
+	err = store.Put("gridfs-failure.tar.gz", strings.NewReader("old content"))
+	c.Assert(err, check.IsNil)
+	defer store.Delete("gridfs-failure.tar.gz")
+	err = store.Put("gridfs-failure.tar.gz", failingReader{})
+	c.Assert(err, check.ErrorMatches, "read failure")
+	file, err := store.Get("gridfs-failure.tar.gz")
+	c.Assert(err, check.IsNil)
+	defer file.Close()
+	content, err := ioutil.ReadAll(file)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "old content")
+}
+
+func (MongoSuite) TestGridFSStoreInterruptedPut(c *check.C) {
+	store := NewGridFSStore("archives_test")
+	db, err := conn()
+	c.Assert(err, check.IsNil)
+	defer db.Close()
+	gfs := store.gridFS(db)
+	// A write interrupted before the file is complete leaves its chunks
+	// behind, without the file.
+	err = gfs.Chunks.Insert(bson.M{"files_id": "gridfs-interrupted.tar.gz", "n": 0, "data": []byte("stale")})
+	c.Assert(err, check.IsNil)
+	_, err = store.Stat("gridfs-interrupted.tar.gz")
+	c.Assert(err, check.Equals, ErrBlobNotFound)
+	err = store.Put("gridfs-interrupted.tar.gz", strings.NewReader("some content"))
+	c.Assert(err, check.IsNil)
+	defer store.Delete("gridfs-interrupted.tar.gz")
+	file, err := store.Get("gridfs-interrupted.tar.gz")
+	c.Assert(err, check.IsNil)
+	defer file.Close()
+	content, err := ioutil.ReadAll(file)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "some content")
+	n, err := gfs.Files.Find(bson.M{"filename": "gridfs-interrupted.tar.gz"}).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 1)
+}
+
+func (MongoSuite) TestGridFSStoreArchiveID(c *check.C) {
+	store := NewGridFSStore("archives_test")
+	archive, err := NewArchive(strings.NewReader("some content"), "app.zip", ArchiveOptions{Format: FormatZip}, store)
+	c.Assert(err, check.IsNil)
+	defer store.Delete(archive.ID)
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	defer db.Delete(archive.ID)
+	c.Assert(archive.Path, check.Equals, archive.ID)
+	info, err := store.Stat(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Size, check.Equals, int64(12))
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// instanceID identifies this instance of the server as the owner of the
+// archives it builds.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "archive-server"
+	}
+	var buf [4]byte
+	rand.Read(buf[:])
+	return fmt.Sprintf("%s-%x", hostname, buf)
+}
+
+// keepAlive periodically records a heartbeat for the archive while it is
+// being built by this instance, until the returned function is called.
+func (archive *Archive) keepAlive(db ArchiveStore) func() {
+	interval := buildLease / 4
+	if interval <= 0 {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := db.Heartbeat(archive.ID, instanceID); err != nil {
+					log.Printf("[ERROR] Failed to record heartbeat of archive %q: %s", archive.ID, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// RecoverArchives takes over the archives whose builders did not record a
+// heartbeat in the given lease, as happens when the instance building them
+// stops. Archives generated from git are generated again, while uploads,
+// which can't be resumed, are marked as failed. It returns the number of
+// recovered archives.
+func RecoverArchives(lease time.Duration, store BlobStore) (int, error) {
+	db, err := archiveStore()
+	if err != nil {
+		return 0, err
+	}
+	archives, err := db.List(ArchiveQuery{Status: []Status{StatusBuilding}})
+	if err != nil {
+		return 0, err
+	}
+	expiredBefore := time.Now().Add(-lease)
+	// The owner of an archive keeps its heartbeat while the archive waits
+	// in its queue, so claiming by the heartbeat in the record only takes
+	// archives whose owner stopped. The exception are the jobs waiting in
+	// the queue shared in MongoDB, which belong to no server until a worker
+	// claims them.
+	queue := jobQueue()
+	_, shared := queue.(*MongoJobQueue)
+	var recovered int
+	for _, archive := range archives {
+		if archive.Source != nil && shared && queue.Position(archive.ID) > 0 {
+			continue
+		}
+		claimed, err := db.Claim(archive.ID, instanceID, expiredBefore)
+		if err != nil {
+			return recovered, err
+		}
+		if !claimed {
+			continue
+		}
+		recovered++
+		if archive.Source != nil {
+			log.Printf("[INFO] Resuming the generation of archive %q, abandoned by %q", archive.ID, archive.Owner)
+			archive.Owner = instanceID
+			if err := queue.Enqueue(archive, store, db); err != nil {
+				log.Printf("[ERROR] Failed to enqueue archive %q: %s", archive.ID, err)
+			}
+			continue
+		}
+		log.Printf("[ERROR] Archive %q was abandoned by %q while being built", archive.ID, archive.Owner)
+		archive.Log = fmt.Sprintf("the build of the archive was interrupted: no heartbeat from %s since %s", archive.Owner, archive.Heartbeat.Format(time.RFC3339))
+		archive.Owner = instanceID
+		_, err = db.UpdateStatusIf(archive.ID, StatusBuilding, StatusError, archive.Log)
+		notifyArchive(archive.ID)
+		if err != nil {
+			return recovered, err
+		}
+	}
+	return recovered, nil
+}
+
+// recoverArchives recovers abandoned archives right away and then
+// periodically.
+func recoverArchives(lease time.Duration) {
+	for {
+		store, err := blobStore()
+		if err == nil {
+			_, err = RecoverArchives(lease, store)
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to recover abandoned archives: %s", err)
+		}
+		time.Sleep(lease)
+	}
+}
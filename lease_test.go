@@ -0,0 +1,120 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tsuru/commandmocker"
+	"gopkg.in/check.v1"
+)
+
+func (Suite) TestRecoverArchives(c *check.C) {
+	defer useIsolatedMetadata(c)()
+	tmpdir, err := commandmocker.Add("git", "success")
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(tmpdir)
+	store := NewLocalStore(baseDir)
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	stale := time.Now().Add(-time.Hour)
+	path, _ := filepath.Abs("testdata/test.git")
+	generated := Archive{
+		ID:        strings.Repeat("a", 128),
+		Status:    StatusBuilding,
+		Source:    &GitSource{Repository: path, Ref: "master", Prefix: "project"},
+		Owner:     "gone",
+		Heartbeat: stale,
+	}
+	uploaded := Archive{ID: strings.Repeat("b", 128), Status: StatusBuilding, Owner: "gone", Heartbeat: stale}
+	alive := Archive{ID: strings.Repeat("c", 128), Status: StatusBuilding, Owner: "alive", Heartbeat: time.Now()}
+	for _, archive := range []*Archive{&generated, &uploaded, &alive} {
+		archive.Path = archive.ID + ".tar.gz"
+		archive.CreatedAt, archive.UpdatedAt = stale, stale
+		err = db.Insert(*archive)
+		c.Assert(err, check.IsNil)
+	}
+	defer os.Remove(filepath.Join(baseDir, generated.Path))
+	recovered, err := RecoverArchives(time.Minute, store)
+	c.Assert(err, check.IsNil)
+	c.Assert(recovered, check.Equals, 2)
+	wait(c, 3e9, func() bool {
+		archive, err := db.Get(generated.ID)
+		return err == nil && archive.Status == StatusReady
+	})
+	archive, err := db.Get(generated.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Owner, check.Equals, instanceID)
+	content, err := ioutil.ReadFile(filepath.Join(baseDir, generated.Path))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "success")
+	archive, err = db.Get(uploaded.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Status, check.Equals, StatusError)
+	c.Assert(archive.Log, check.Matches, "the build of the archive was interrupted: no heartbeat from gone since .*")
+	archive, err = db.Get(alive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Status, check.Equals, StatusBuilding)
+	c.Assert(archive.Owner, check.Equals, "alive")
+	recovered, err = RecoverArchives(time.Minute, store)
+	c.Assert(err, check.IsNil)
+	c.Assert(recovered, check.Equals, 0)
+}
+
+func (Suite) TestRecoverArchivesQueued(c *check.C) {
+	defer useIsolatedMetadata(c)()
+	oldLease := buildLease
+	buildLease = 40 * time.Millisecond
+	defer func() { buildLease = oldLease }()
+	tmpdir, err := commandmocker.Add("git", "success")
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(tmpdir)
+	store := blockingStore{LocalStore: NewLocalStore(baseDir), release: make(chan struct{})}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	stale := time.Now().Add(-time.Hour)
+	path, _ := filepath.Abs("testdata/test.git")
+	var archives []Archive
+	for _, id := range []string{strings.Repeat("d", 128), strings.Repeat("e", 128)} {
+		archive := Archive{
+			ID:        id,
+			Path:      id + ".tar.gz",
+			Status:    StatusBuilding,
+			Source:    &GitSource{Repository: path, Ref: "master", Prefix: "project"},
+			Owner:     instanceID,
+			Heartbeat: stale,
+		}
+		err = db.Insert(archive)
+		c.Assert(err, check.IsNil)
+		archives = append(archives, archive)
+		defer os.Remove(filepath.Join(baseDir, archive.Path))
+	}
+	// The first archive keeps the only worker busy, so the second one
+	// waits in the queue, which is not the queue of the server.
+	q := NewJobQueue(1, 1)
+	err = q.Enqueue(archives[0], store, db)
+	c.Assert(err, check.IsNil)
+	wait(c, 3e9, func() bool { return q.Position(archives[0].ID) == 0 })
+	err = q.Enqueue(archives[1], store, db)
+	c.Assert(err, check.IsNil)
+	wait(c, 3e9, func() bool {
+		archive, err := db.Get(archives[1].ID)
+		return err == nil && archive.Heartbeat.After(stale)
+	})
+	recovered, err := RecoverArchives(time.Second, store)
+	c.Assert(err, check.IsNil)
+	c.Assert(recovered, check.Equals, 0)
+	close(store.release)
+	c.Assert(q.Drain(3*time.Second), check.Equals, true)
+	for _, archive := range archives {
+		got, err := db.Get(archive.ID)
+		c.Assert(err, check.IsNil)
+		c.Assert(got.Status, check.Equals, StatusReady)
+	}
+}
@@ -0,0 +1,386 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrReadOnlyStore is returned when changing a store opened with
+// LoadFileStore.
+var ErrReadOnlyStore = errors.New("the metadata file is open read-only")
+
+// MemoryStore is an ArchiveStore that keeps archives in memory. When created
+// with NewFileStore, every change is also appended to a log file, so the
+// archives survive restarts of the server.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	archives map[string]Archive
+	path     string
+	file     *os.File
+	lock     *os.File
+	readOnly bool
+	records  int
+	// stale is set when the log has to be rewritten before it is
+	// appended to, as it has an older format or an interrupted record.
+	stale bool
+}
+
+// fileStoreCompaction is the minimum number of records in the log of a file
+// store before it is compacted. The log is compacted when it also has more
+// than twice as many records as archives.
+var fileStoreCompaction = 1000
+
+// fileRecord is a line of the log of a file store, holding either the new
+// state of an archive or the ID of a deleted archive.
+type fileRecord struct {
+	Archive *Archive `json:",omitempty"`
+	Deleted string   `json:",omitempty"`
+}
+
+// NewMemoryStore returns an empty MemoryStore that is not persisted.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{archives: make(map[string]Archive)}
+}
+
+// NewFileStore returns a MemoryStore persisted in the file at path, loading
+// the archives previously stored in the file. Only one process may change
+// the file, so the store holds an exclusive lock on path+".lock" until it
+// is closed, and fails when another process holds it. Files written by
+// older versions, holding a JSON array of archives, are converted to the
+// log on the first change.
+func NewFileStore(path string) (*MemoryStore, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("the metadata file %s is in use by another process", path)
+		}
+		return nil, err
+	}
+	store, err := LoadFileStore(path)
+	if err == nil {
+		store.readOnly = false
+		store.lock = lock
+		store.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	}
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// LoadFileStore returns a MemoryStore with the archives stored in the file
+// at path that can't be changed, for inspecting the file while a server
+// uses it.
+func LoadFileStore(path string) (*MemoryStore, error) {
+	store := NewMemoryStore()
+	store.path = path
+	store.readOnly = true
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var archives []Archive
+		err = json.Unmarshal(data, &archives)
+		if err != nil {
+			return nil, err
+		}
+		for _, archive := range archives {
+			store.archives[archive.ID] = archive
+		}
+		store.stale = true
+	} else if err = store.replay(data); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Close closes the log of the store and releases its lock.
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if s.lock != nil {
+		s.lock.Close()
+		s.lock = nil
+	}
+	s.readOnly = s.path != ""
+	return nil
+}
+
+// replay applies the records of the log. A record without the final line
+// break is the result of an interrupted write, and is ignored.
+func (s *MemoryStore) replay(data []byte) error {
+	for len(data) > 0 {
+		line := data
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			data = nil
+		} else {
+			line, data = data[:end], data[end+1:]
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var record fileRecord
+		err := json.Unmarshal(line, &record)
+		if err != nil {
+			if end < 0 && line[0] == '{' {
+				s.stale = true
+				return nil
+			}
+			return err
+		}
+		s.records++
+		if record.Archive != nil {
+			s.archives[record.Archive.ID] = *record.Archive
+		} else {
+			delete(s.archives, record.Deleted)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Insert(archive Archive) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.archives[archive.ID] = archive
+	return s.save(fileRecord{Archive: &archive}, true)
+}
+
+func (s *MemoryStore) Get(id string) (*Archive, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	archive, ok := s.archives[id]
+	if !ok {
+		return nil, ErrArchiveNotFound
+	}
+	return &archive, nil
+}
+
+func (s *MemoryStore) UpdateStatus(id string, status Status, log string) error {
+	return s.update(id, func(archive *Archive) {
+		archive.Status = status
+		archive.Log = log
+		if status == StatusDestroyed {
+			archive.DestroyedAt = time.Now()
+		}
+	})
+}
+
+func (s *MemoryStore) UpdateStatusIf(id string, expected, status Status, log string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	archive, ok := s.archives[id]
+	if !ok || archive.Status != expected {
+		return false, nil
+	}
+	archive.Status = status
+	archive.Log = log
+	archive.UpdatedAt = time.Now()
+	if status == StatusDestroyed {
+		archive.DestroyedAt = archive.UpdatedAt
+	}
+	s.archives[id] = archive
+	return true, s.save(fileRecord{Archive: &archive}, true)
+}
+
+func (s *MemoryStore) UpdateContent(id string, size int64, digest string) error {
+	return s.update(id, func(archive *Archive) {
+		archive.Size = size
+		archive.Digest = digest
+	})
+}
+
+func (s *MemoryStore) DecrementDownloads(id string) (int, error) {
+	var left int
+	err := s.update(id, func(archive *Archive) {
+		archive.MaxDownloads--
+		left = archive.MaxDownloads
+	})
+	return left, err
+}
+
+func (s *MemoryStore) Heartbeat(id, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	archive, ok := s.archives[id]
+	if !ok || archive.Owner != owner || archive.Status != StatusBuilding {
+		return ErrArchiveNotFound
+	}
+	archive.Heartbeat = time.Now()
+	s.archives[id] = archive
+	// Losing a heartbeat in a crash is harmless, so it is not synced.
+	return s.save(fileRecord{Archive: &archive}, false)
+}
+
+func (s *MemoryStore) Claim(id, owner string, expiredBefore time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	archive, ok := s.archives[id]
+	if !ok || archive.Status != StatusBuilding {
+		return false, nil
+	}
+	last := archive.Heartbeat
+	if last.IsZero() {
+		last = archive.UpdatedAt
+	}
+	if !last.Before(expiredBefore) {
+		return false, nil
+	}
+	archive.Owner = owner
+	archive.Heartbeat = time.Now()
+	archive.UpdatedAt = archive.Heartbeat
+	s.archives[id] = archive
+	return true, s.save(fileRecord{Archive: &archive}, true)
+}
+
+func (s *MemoryStore) List(query ArchiveQuery) ([]Archive, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	all := s.list()
+	if query.Descending {
+		sort.Sort(sort.Reverse(archivesByCreation(all)))
+	}
+	archives := []Archive{}
+	for _, archive := range all {
+		if query.Limit > 0 && len(archives) == query.Limit {
+			break
+		}
+		if query.matches(archive) {
+			archives = append(archives, archive)
+		}
+	}
+	return archives, nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.archives[id]; !ok {
+		return ErrArchiveNotFound
+	}
+	delete(s.archives, id)
+	return s.save(fileRecord{Deleted: id}, true)
+}
+
+// update applies fn to the archive with the given ID, touching its
+// UpdatedAt field.
+func (s *MemoryStore) update(id string, fn func(*Archive)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	archive, ok := s.archives[id]
+	if !ok {
+		return ErrArchiveNotFound
+	}
+	fn(&archive)
+	archive.UpdatedAt = time.Now()
+	s.archives[id] = archive
+	return s.save(fileRecord{Archive: &archive}, true)
+}
+
+// list returns the archives sorted by creation time. The caller must hold
+// the lock.
+func (s *MemoryStore) list() []Archive {
+	archives := make([]Archive, 0, len(s.archives))
+	for _, archive := range s.archives {
+		archives = append(archives, archive)
+	}
+	sort.Sort(archivesByCreation(archives))
+	return archives
+}
+
+// save appends the record of a change to the log of the store, if any,
+// syncing the file when requested. Once the log grows large enough, it is
+// compacted instead. The caller must hold the lock.
+func (s *MemoryStore) save(record fileRecord, sync bool) error {
+	if s.path == "" {
+		return nil
+	}
+	if s.readOnly {
+		return ErrReadOnlyStore
+	}
+	if s.stale || s.records >= fileStoreCompaction && s.records > 2*len(s.archives) {
+		return s.compact()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.records++
+	_, err = s.file.Write(append(data, '\n'))
+	if err == nil && sync {
+		err = s.file.Sync()
+	}
+	return err
+}
+
+// compact replaces the log with one record for each archive, atomically,
+// and reopens it for appending. The caller must hold the lock.
+func (s *MemoryStore) compact() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(w)
+	archives := s.list()
+	for i := range archives {
+		if err = encoder.Encode(fileRecord{Archive: &archives[i]}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	s.records = len(archives)
+	s.stale = false
+	return err
+}
+
+type archivesByCreation []Archive
+
+func (a archivesByCreation) Len() int      { return len(a) }
+func (a archivesByCreation) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a archivesByCreation) Less(i, j int) bool {
+	return archiveCursor(a[i]).less(archiveCursor(a[j]))
+}
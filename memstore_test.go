@@ -0,0 +1,188 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/check.v1"
+)
+
+func (Suite) TestMemoryStore(c *check.C) {
+	testArchiveStore(c, NewMemoryStore())
+}
+
+func (Suite) TestFileStore(c *check.C) {
+	path := filepath.Join(baseDir, "metadata-test.json")
+	defer os.Remove(path)
+	defer os.Remove(path + ".lock")
+	store, err := NewFileStore(path)
+	c.Assert(err, check.IsNil)
+	testArchiveStore(c, store)
+}
+
+func (Suite) TestFileStorePersistence(c *check.C) {
+	path := filepath.Join(baseDir, "metadata-persistence.json")
+	defer os.Remove(path)
+	defer os.Remove(path + ".lock")
+	store, err := NewFileStore(path)
+	c.Assert(err, check.IsNil)
+	err = store.Insert(Archive{ID: "persisted", Path: "persisted.tar.gz", Status: StatusBuilding})
+	c.Assert(err, check.IsNil)
+	err = store.UpdateStatus("persisted", StatusReady, "done")
+	c.Assert(err, check.IsNil)
+	c.Assert(store.Close(), check.IsNil)
+	store, err = NewFileStore(path)
+	c.Assert(err, check.IsNil)
+	archive, err := store.Get("persisted")
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Path, check.Equals, "persisted.tar.gz")
+	c.Assert(archive.Status, check.Equals, StatusReady)
+	c.Assert(archive.Log, check.Equals, "done")
+}
+
+func (Suite) TestFileStoreInvalidFile(c *check.C) {
+	path := filepath.Join(baseDir, "metadata-invalid.json")
+	defer os.Remove(path)
+	defer os.Remove(path + ".lock")
+	f, err := os.Create(path)
+	c.Assert(err, check.IsNil)
+	f.Write([]byte("not json"))
+	f.Close()
+	_, err = NewFileStore(path)
+	c.Assert(err, check.NotNil)
+	// The lock is released when the file can't be loaded.
+	c.Assert(ioutil.WriteFile(path, nil, 0644), check.IsNil)
+	store, err := NewFileStore(path)
+	c.Assert(err, check.IsNil)
+	store.Close()
+}
+
+func (Suite) TestFileStoreCompaction(c *check.C) {
+	old := fileStoreCompaction
+	fileStoreCompaction = 10
+	defer func() { fileStoreCompaction = old }()
+	path := filepath.Join(baseDir, "metadata-compaction.json")
+	defer os.Remove(path)
+	defer os.Remove(path + ".lock")
+	store, err := NewFileStore(path)
+	c.Assert(err, check.IsNil)
+	err = store.Insert(Archive{ID: "compacted", Status: StatusBuilding, MaxDownloads: 100})
+	c.Assert(err, check.IsNil)
+	err = store.Insert(Archive{ID: "deleted", Status: StatusReady})
+	c.Assert(err, check.IsNil)
+	c.Assert(store.Delete("deleted"), check.IsNil)
+	for i := 0; i < 25; i++ {
+		_, err = store.DecrementDownloads("compacted")
+		c.Assert(err, check.IsNil)
+	}
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Count(data, []byte("\n")) <= 10, check.Equals, true)
+	c.Assert(store.Close(), check.IsNil)
+	store, err = NewFileStore(path)
+	c.Assert(err, check.IsNil)
+	archive, err := store.Get("compacted")
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.MaxDownloads, check.Equals, 75)
+	_, err = store.Get("deleted")
+	c.Assert(err, check.Equals, ErrArchiveNotFound)
+}
+
+func (Suite) TestFileStoreInterruptedWrite(c *check.C) {
+	path := filepath.Join(baseDir, "metadata-interrupted.json")
+	defer os.Remove(path)
+	defer os.Remove(path + ".lock")
+	store, err := NewFileStore(path)
+	c.Assert(err, check.IsNil)
+	err = store.Insert(Archive{ID: "kept", Status: StatusReady})
+	c.Assert(err, check.IsNil)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	c.Assert(err, check.IsNil)
+	f.Write([]byte(`{"Archive":{"ID":"lost"`))
+	f.Close()
+	c.Assert(store.Close(), check.IsNil)
+	store, err = NewFileStore(path)
+	c.Assert(err, check.IsNil)
+	_, err = store.Get("kept")
+	c.Assert(err, check.IsNil)
+	_, err = store.Get("lost")
+	c.Assert(err, check.Equals, ErrArchiveNotFound)
+}
+
+func (Suite) TestFileStoreArrayFile(c *check.C) {
+	path := filepath.Join(baseDir, "metadata-array.json")
+	defer os.Remove(path)
+	defer os.Remove(path + ".lock")
+	data, err := json.Marshal([]Archive{{ID: "old", Status: StatusReady}})
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(path, data, 0644)
+	c.Assert(err, check.IsNil)
+	store, err := NewFileStore(path)
+	c.Assert(err, check.IsNil)
+	archive, err := store.Get("old")
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Status, check.Equals, StatusReady)
+	c.Assert(store.Close(), check.IsNil)
+	store, err = NewFileStore(path)
+	c.Assert(err, check.IsNil)
+	_, err = store.Get("old")
+	c.Assert(err, check.IsNil)
+}
+
+func (Suite) TestFileStoreLock(c *check.C) {
+	path := filepath.Join(baseDir, "metadata-lock.json")
+	defer os.Remove(path)
+	defer os.Remove(path + ".lock")
+	store, err := NewFileStore(path)
+	c.Assert(err, check.IsNil)
+	defer store.Close()
+	c.Assert(store.Insert(Archive{ID: "one", Status: StatusReady}), check.IsNil)
+	_, err = NewFileStore(path)
+	c.Assert(err, check.ErrorMatches, "the metadata file .* is in use by another process")
+	snapshot, err := LoadFileStore(path)
+	c.Assert(err, check.IsNil)
+	_, err = snapshot.Get("one")
+	c.Assert(err, check.IsNil)
+	c.Assert(snapshot.Insert(Archive{ID: "rejected"}), check.Equals, ErrReadOnlyStore)
+	c.Assert(store.Insert(Archive{ID: "two", Status: StatusReady}), check.IsNil)
+	c.Assert(store.Close(), check.IsNil)
+	store, err = NewFileStore(path)
+	c.Assert(err, check.IsNil)
+	for _, id := range []string{"one", "two"} {
+		_, err = store.Get(id)
+		c.Assert(err, check.IsNil, check.Commentf("archive %s", id))
+	}
+	_, err = store.Get("rejected")
+	c.Assert(err, check.Equals, ErrArchiveNotFound)
+}
+
+func (Suite) TestFileStoreOpenDoesNotWrite(c *check.C) {
+	old := fileStoreCompaction
+	fileStoreCompaction = 2
+	defer func() { fileStoreCompaction = old }()
+	path := filepath.Join(baseDir, "metadata-open.json")
+	defer os.Remove(path)
+	defer os.Remove(path + ".lock")
+	data, err := json.Marshal([]Archive{{ID: "old", Status: StatusReady}})
+	c.Assert(err, check.IsNil)
+	c.Assert(ioutil.WriteFile(path, data, 0644), check.IsNil)
+	_, err = LoadFileStore(path)
+	c.Assert(err, check.IsNil)
+	store, err := NewFileStore(path)
+	c.Assert(err, check.IsNil)
+	defer store.Close()
+	got, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(got), check.Equals, string(data))
+	c.Assert(store.Insert(Archive{ID: "new", Status: StatusReady}), check.IsNil)
+	got, err = ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Count(got, []byte("\n")), check.Equals, 2)
+}
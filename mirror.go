@@ -0,0 +1,143 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteRepositoryPattern matches the URLs of repositories in the schemes
+// supported by the server, like https://example.com/app.git, and the scp-like
+// syntax of ssh, like git@example.com:app.git. Neither the user nor the host
+// may start with a dash, so that git never reads them as options.
+var remoteRepositoryPattern = regexp.MustCompile(`^((https?|ssh|git|file)://|[^-/@:][^/@:]*@[^-/@:][^/@:]*:)`)
+
+var (
+	mirrorLocksMutex sync.Mutex
+	mirrorLocks      = make(map[string]*sync.Mutex)
+)
+
+// isRemoteRepository reports whether path is the URL of a repository,
+// instead of a path in the local filesystem.
+func isRemoteRepository(path string) bool {
+	return remoteRepositoryPattern.MatchString(path)
+}
+
+// mirrorPath returns the directory of the mirror of the repository at url.
+func mirrorPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(mirrorDir, hex.EncodeToString(sum[:16])+".git")
+}
+
+func lockMirror(dir string) func() {
+	mirrorLocksMutex.Lock()
+	l, ok := mirrorLocks[dir]
+	if !ok {
+		l = new(sync.Mutex)
+		mirrorLocks[dir] = l
+	}
+	mirrorLocksMutex.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// fetchMirror fetches the last commit of ref from the repository at url into
+// its mirror, a bare repository in the directory given by the -mirror-dir
+// flag. It returns the directory of the mirror and the fetched commit, which
+// is the one archived.
+func fetchMirror(url, ref string) (string, string, error) {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return "", "", fmt.Errorf("invalid reference %q", ref)
+	}
+	if !isRemoteRepository(url) {
+		return "", "", fmt.Errorf("invalid repository %q", url)
+	}
+	dir := mirrorPath(url)
+	defer lockMirror(dir)()
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); os.IsNotExist(err) {
+		err = os.MkdirAll(mirrorDir, 0755)
+		if err != nil {
+			return "", "", err
+		}
+		if out, err := git("", "init", "-q", "--bare", dir); err != nil {
+			return "", "", fmt.Errorf("failed to create mirror of %s: %s", url, out)
+		}
+	}
+	out, err := git(dir, "fetch", "-q", "--depth=1", "--force", "--no-tags", "--", url, ref)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to fetch %s from %s: %s", ref, url, out)
+	}
+	commit, err := git(dir, "rev-parse", "--verify", "FETCH_HEAD^{commit}")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to fetch %s from %s: %s", ref, url, commit)
+	}
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	return dir, commit, nil
+}
+
+// git runs the git command in dir, returning its combined output. Git never
+// prompts for credentials, so fetches from repositories that require them
+// fail instead of hanging.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil && len(out) == 0 {
+		out = []byte(err.Error())
+	}
+	return strings.TrimSpace(string(out)), err
+}
+
+// CollectMirrors removes the mirrors that were not used in the given
+// duration, returning the number of removed mirrors.
+func CollectMirrors(maxAge time.Duration) (int, error) {
+	entries, err := ioutil.ReadDir(mirrorDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	limit := time.Now().Add(-maxAge)
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasSuffix(entry.Name(), ".git") || entry.ModTime().After(limit) {
+			continue
+		}
+		dir := filepath.Join(mirrorDir, entry.Name())
+		unlock := lockMirror(dir)
+		fi, err := os.Stat(dir)
+		if err == nil && fi.ModTime().Before(limit) {
+			if os.RemoveAll(dir) == nil {
+				removed++
+				log.Printf("[INFO] removed unused mirror %q", dir)
+			}
+		}
+		unlock()
+	}
+	return removed, nil
+}
+
+// collectMirrors periodically removes unused mirrors.
+func collectMirrors(maxAge, interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := CollectMirrors(maxAge); err != nil {
+			log.Printf("[ERROR] Failed to remove unused mirrors: %s", err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// useMirrorDir makes the mirrors be created in a temporary directory.
+func useMirrorDir(c *check.C) func() {
+	oldDir := mirrorDir
+	mirrorDir = filepath.Join(c.MkDir(), "mirrors")
+	return func() { mirrorDir = oldDir }
+}
+
+// remoteRepository creates a repository with two commits, the first one
+// tagged as v1.0, returning its path.
+func remoteRepository(c *check.C) string {
+	dir := filepath.Join(c.MkDir(), "remote")
+	gitCommand(c, c.MkDir(), "init", "-q", dir)
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("first\n"), 0644)
+	gitCommand(c, dir, "add", "README")
+	gitCommand(c, dir, "commit", "-q", "-m", "first")
+	gitCommand(c, dir, "tag", "-a", "-m", "release", "v1.0")
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("second\n"), 0644)
+	gitCommand(c, dir, "commit", "-q", "-a", "-m", "second")
+	return dir
+}
+
+func (Suite) TestIsRemoteRepository(c *check.C) {
+	var tests = []struct {
+		path   string
+		remote bool
+	}{
+		{"/var/repositories/app.git", false},
+		{"app.git", false},
+		{"./dir:with:colons", false},
+		{"file:///var/repositories/app.git", true},
+		{"https://example.com/app.git", true},
+		{"ssh://git@example.com/app.git", true},
+		{"git://example.com/app.git", true},
+		{"git@example.com:app.git", true},
+		{"git+ssh://example.com/app.git", false},
+		{"ext::sh -c touch% /tmp/pwned", false},
+		{"--upload-pack=touch /tmp/pwned x@y:", false},
+		{"-x@example.com:app.git", false},
+		{"git@-oProxyCommand=touch /tmp/pwned:app.git", false},
+	}
+	for _, t := range tests {
+		c.Check(isRemoteRepository(t.path), check.Equals, t.remote, check.Commentf("%s", t.path))
+	}
+}
+
+func (Suite) TestFetchMirror(c *check.C) {
+	defer useMirrorDir(c)()
+	remote := remoteRepository(c)
+	url := "file://" + remote
+	dir, commit, err := fetchMirror(url, "master")
+	c.Assert(err, check.IsNil)
+	c.Assert(dir, check.Equals, mirrorPath(url))
+	c.Assert(commit, check.Equals, gitCommand(c, remote, "rev-parse", "master"))
+	_, err = os.Stat(filepath.Join(dir, "shallow"))
+	c.Assert(err, check.IsNil)
+	_, commit, err = fetchMirror(url, "v1.0")
+	c.Assert(err, check.IsNil)
+	c.Assert(commit, check.Equals, gitCommand(c, remote, "rev-parse", "v1.0^{commit}"))
+	_, _, err = fetchMirror(url, "unknown")
+	c.Assert(err, check.ErrorMatches, "failed to fetch unknown from file://.*")
+	_, _, err = fetchMirror(url, "--upload-pack=touch /tmp/pwned")
+	c.Assert(err, check.ErrorMatches, "invalid reference .*")
+	_, _, err = fetchMirror("--upload-pack=touch /tmp/pwned x@y:", "master")
+	c.Assert(err, check.ErrorMatches, "invalid repository .*")
+	_, _, err = fetchMirror("ext::sh -c touch% /tmp/pwned", "master")
+	c.Assert(err, check.ErrorMatches, "invalid repository .*")
+}
+
+func (Suite) TestFetchMirrorHTTP(c *check.C) {
+	defer useMirrorDir(c)()
+	remote := remoteRepository(c)
+	root := c.MkDir()
+	gitCommand(c, root, "clone", "-q", "--bare", remote, "app.git")
+	gitPath, _ := exec.LookPath("git")
+	server := httptest.NewServer(&cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	defer server.Close()
+	_, commit, err := fetchMirror(server.URL+"/app.git", "master")
+	c.Assert(err, check.IsNil)
+	c.Assert(commit, check.Equals, gitCommand(c, remote, "rev-parse", "master"))
+}
+
+func (Suite) TestLegacyArchiveRemote(c *check.C) {
+	defer useMirrorDir(c)()
+	remote := remoteRepository(c)
+	archive, err := LegacyArchive("file://"+remote, "v1.0", "app", ArchiveOptions{Format: FormatTar}, NewLocalStore(baseDir))
+	c.Assert(err, check.IsNil)
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	defer db.Delete(archive.ID)
+	defer os.Remove(filepath.Join(baseDir, archive.Path))
+	wait(c, 5e9, func() bool {
+		got, err := db.Get(archive.ID)
+		return err == nil && got.Status != StatusBuilding
+	})
+	got, err := db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(got.Status, check.Equals, StatusReady, check.Commentf("%s", got.Log))
+	f, err := os.Open(filepath.Join(baseDir, archive.Path))
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	expected := gitCommand(c, remote, "archive", "--format=tar", "--prefix=app/", "v1.0")
+	c.Assert(tarEntries(c, f), check.DeepEquals, tarEntries(c, strings.NewReader(expected)))
+}
+
+func (Suite) TestLegacyArchiveRemoteFailure(c *check.C) {
+	defer useMirrorDir(c)()
+	archive, err := LegacyArchive("file:///nonexistent/app.git", "master", "app", ArchiveOptions{}, NewLocalStore(baseDir))
+	c.Assert(err, check.IsNil)
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	defer db.Delete(archive.ID)
+	wait(c, 5e9, func() bool {
+		got, err := db.Get(archive.ID)
+		return err == nil && got.Status == StatusError
+	})
+	got, err := db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(got.Log, check.Matches, "(?s)failed to fetch master from file:///nonexistent/app.git: .*does not appear to be a git repository.*")
+}
+
+func (Suite) TestCollectMirrors(c *check.C) {
+	defer useMirrorDir(c)()
+	old, recent := filepath.Join(mirrorDir, "old.git"), filepath.Join(mirrorDir, "recent.git")
+	for _, dir := range []string{old, recent} {
+		c.Assert(os.MkdirAll(dir, 0755), check.IsNil)
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	c.Assert(os.Chtimes(old, past, past), check.IsNil)
+	removed, err := CollectMirrors(time.Hour)
+	c.Assert(err, check.IsNil)
+	c.Assert(removed, check.Equals, 1)
+	_, err = os.Stat(old)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	_, err = os.Stat(recent)
+	c.Assert(err, check.IsNil)
+}
@@ -0,0 +1,289 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const jobsCollectionName = "jobs"
+
+// jobPollInterval is the interval in which idle workers look for pending
+// jobs in the database.
+const jobPollInterval = time.Second
+
+// maxJobAttempts is the number of times a job is claimed before its archive
+// is marked as failed, protecting the workers from archives that crash the
+// server that generates them.
+const maxJobAttempts = 3
+
+// generationJob is the generation of an archive, stored in the jobs
+// collection. The job is pending while its lease is expired, which includes
+// jobs never claimed and jobs whose worker stopped.
+type generationJob struct {
+	ID         string `bson:"_id"`
+	Owner      string `bson:",omitempty"`
+	LeaseUntil time.Time
+	Attempts   int
+	CreatedAt  time.Time
+}
+
+func pendingJobs(now time.Time) bson.M {
+	return bson.M{"leaseuntil": bson.M{"$lt": now}}
+}
+
+// MongoJobQueue is a GenerationQueue kept in MongoDB, which lets any write
+// server generate the archives created in the others. Workers claim jobs
+// atomically with a lease, which is extended while the archive is
+// generated, so the jobs of a server that stops are claimed by others once
+// their lease expires.
+type MongoJobQueue struct {
+	size     int
+	lease    time.Duration
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+}
+
+// NewMongoJobQueue starts the given number of workers, which may be zero in
+// servers that only enqueue jobs, for a queue that holds up to size pending
+// jobs.
+func NewMongoJobQueue(workers, size int, lease time.Duration) *MongoJobQueue {
+	q := MongoJobQueue{
+		size:  size,
+		lease: lease,
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+	}
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return &q
+}
+
+// Enqueue inserts a job for the archive. Enqueueing an archive that already
+// has a job does nothing.
+func (q *MongoJobQueue) Enqueue(archive Archive, _ BlobStore, _ ArchiveStore) error {
+	select {
+	case <-q.stop:
+		return ErrQueueClosed
+	default:
+	}
+	db, err := conn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	jobs := db.Collection(jobsCollectionName)
+	pending, err := jobs.Find(pendingJobs(time.Now())).Count()
+	if err != nil {
+		return err
+	}
+	if pending >= q.size {
+		return ErrQueueFull
+	}
+	err = jobs.Insert(generationJob{ID: archive.ID, CreatedAt: archive.CreatedAt})
+	if mgo.IsDup(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *MongoJobQueue) Position(id string) int {
+	db, err := conn()
+	if err != nil {
+		return 0
+	}
+	defer db.Close()
+	jobs := db.Collection(jobsCollectionName)
+	now := time.Now()
+	var job generationJob
+	err = jobs.FindId(id).One(&job)
+	if err != nil || !job.LeaseUntil.Before(now) {
+		return 0
+	}
+	selector := pendingJobs(now)
+	selector["createdat"] = bson.M{"$lte": job.CreatedAt}
+	position, err := jobs.Find(selector).Count()
+	if err != nil {
+		return 0
+	}
+	return position
+}
+
+// Drain stops claiming jobs and waits for the jobs claimed by this server.
+// Pending jobs are left to the other servers.
+func (q *MongoJobQueue) Drain(timeout time.Duration) bool {
+	q.stopOnce.Do(func() { close(q.stop) })
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (q *MongoJobQueue) work() {
+	defer q.workers.Done()
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+		job, err := q.claim()
+		if err != nil {
+			log.Printf("[ERROR] Failed to claim generation job: %s", err)
+		}
+		if job == nil {
+			select {
+			case <-q.stop:
+				return
+			case <-q.wake:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+		q.run(job)
+	}
+}
+
+// claim takes the oldest pending job, returning nil when there are no
+// pending jobs.
+func (q *MongoJobQueue) claim() (*generationJob, error) {
+	db, err := conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	now := time.Now()
+	change := mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{"owner": instanceID, "leaseuntil": now.Add(q.lease)},
+			"$inc": bson.M{"attempts": 1},
+		},
+		ReturnNew: true,
+	}
+	var job generationJob
+	_, err = db.Collection(jobsCollectionName).Find(pendingJobs(now)).Sort("createdat").Apply(change, &job)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (q *MongoJobQueue) run(job *generationJob) {
+	db, err := archiveStore()
+	if err != nil {
+		log.Printf("[ERROR] Failed to run generation job %q: %s", job.ID, err)
+		return
+	}
+	store, err := blobStore()
+	if err != nil {
+		log.Printf("[ERROR] Failed to run generation job %q: %s", job.ID, err)
+		return
+	}
+	archive, err := db.Get(job.ID)
+	if err == ErrArchiveNotFound || (err == nil && (archive.Status != StatusBuilding || archive.Source == nil)) {
+		q.remove(job.ID)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to run generation job %q: %s", job.ID, err)
+		return
+	}
+	if job.Attempts > maxJobAttempts {
+		archive.Log = fmt.Sprintf("failed to generate the archive in %d attempts", maxJobAttempts)
+		log.Printf("[ERROR] Failed to generate archive %q in %d attempts", archive.ID, maxJobAttempts)
+		db.UpdateStatusIf(archive.ID, StatusBuilding, StatusError, archive.Log)
+		notifyArchive(archive.ID)
+		q.remove(job.ID)
+		return
+	}
+	// The lease of the job grants the exclusive right to generate the
+	// archive, so the archive is taken over regardless of its heartbeat.
+	_, err = db.Claim(archive.ID, instanceID, time.Now().Add(q.lease))
+	if err != nil {
+		log.Printf("[ERROR] Failed to run generation job %q: %s", job.ID, err)
+		return
+	}
+	stopJob := q.keepAlive(job.ID)
+	stopArchive := archive.keepAlive(db)
+	archive.generate(store)
+	stopArchive()
+	stopJob()
+	q.remove(job.ID)
+}
+
+// keepAlive periodically extends the lease of the job, until the returned
+// function is called.
+func (q *MongoJobQueue) keepAlive(id string) func() {
+	interval := q.lease / 4
+	if interval <= 0 {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := q.extend(id); err != nil {
+					log.Printf("[ERROR] Failed to extend the lease of generation job %q: %s", id, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+func (q *MongoJobQueue) extend(id string) error {
+	db, err := conn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	selector := bson.M{"_id": id, "owner": instanceID}
+	return db.Collection(jobsCollectionName).Update(selector, bson.M{"$set": bson.M{"leaseuntil": time.Now().Add(q.lease)}})
+}
+
+func (q *MongoJobQueue) remove(id string) {
+	db, err := conn()
+	if err != nil {
+		log.Printf("[ERROR] Failed to remove generation job %q: %s", id, err)
+		return
+	}
+	defer db.Close()
+	err = db.Collection(jobsCollectionName).Remove(bson.M{"_id": id, "owner": instanceID})
+	if err != nil && err != mgo.ErrNotFound {
+		log.Printf("[ERROR] Failed to remove generation job %q: %s", id, err)
+	}
+}
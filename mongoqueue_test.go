@@ -0,0 +1,92 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/tsuru/commandmocker"
+	"gopkg.in/check.v1"
+)
+
+func (MongoSuite) TestMongoJobQueue(c *check.C) {
+	oldBackend, oldDir := metadataBackend, baseDir
+	metadataBackend, baseDir = "mongodb", c.MkDir()
+	defer func() { metadataBackend, baseDir = oldBackend, oldDir }()
+	tmpdir, err := commandmocker.Add("git", "success")
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(tmpdir)
+	store, err := blobStore()
+	c.Assert(err, check.IsNil)
+	db := MongoStore{}
+	path, _ := filepath.Abs("testdata/test.git")
+	archive := Archive{
+		ID:        "queued in mongo",
+		Path:      "queued-in-mongo.tar.gz",
+		Status:    StatusBuilding,
+		Source:    &GitSource{Repository: path, Ref: "master", Prefix: "project"},
+		CreatedAt: time.Now(),
+	}
+	err = db.Insert(archive)
+	c.Assert(err, check.IsNil)
+	defer db.Delete(archive.ID)
+	defer store.Delete(archive.Path)
+	enqueuer := NewMongoJobQueue(0, 1, time.Minute)
+	err = enqueuer.Enqueue(archive, store, db)
+	c.Assert(err, check.IsNil)
+	c.Assert(enqueuer.Position(archive.ID), check.Equals, 1)
+	err = enqueuer.Enqueue(Archive{ID: "another archive"}, store, db)
+	c.Assert(err, check.Equals, ErrQueueFull)
+	worker := NewMongoJobQueue(1, 1, time.Minute)
+	wait(c, 3e9, func() bool {
+		got, err := db.Get(archive.ID)
+		return err == nil && got.Status == StatusReady
+	})
+	c.Assert(enqueuer.Position(archive.ID), check.Equals, 0)
+	c.Assert(worker.Drain(3*time.Second), check.Equals, true)
+	err = worker.Enqueue(archive, store, db)
+	c.Assert(err, check.Equals, ErrQueueClosed)
+}
+
+func (MongoSuite) TestMongoJobQueueAbandonedJob(c *check.C) {
+	oldBackend := metadataBackend
+	metadataBackend = "mongodb"
+	defer func() { metadataBackend = oldBackend }()
+	db := MongoStore{}
+	archive := Archive{
+		ID:        "abandoned in mongo",
+		Status:    StatusBuilding,
+		Source:    &GitSource{Repository: "/nonexistent", Ref: "master"},
+		CreatedAt: time.Now(),
+	}
+	err := db.Insert(archive)
+	c.Assert(err, check.IsNil)
+	defer db.Delete(archive.ID)
+	sess, err := conn()
+	c.Assert(err, check.IsNil)
+	defer sess.Close()
+	job := generationJob{
+		ID:         archive.ID,
+		Owner:      "gone",
+		LeaseUntil: time.Now().Add(-time.Minute),
+		Attempts:   maxJobAttempts,
+		CreatedAt:  archive.CreatedAt,
+	}
+	err = sess.Collection(jobsCollectionName).Insert(job)
+	c.Assert(err, check.IsNil)
+	worker := NewMongoJobQueue(1, 1, time.Minute)
+	defer worker.Drain(3 * time.Second)
+	wait(c, 3e9, func() bool {
+		got, err := db.Get(archive.ID)
+		return err == nil && got.Status == StatusError
+	})
+	got, err := db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(got.Log, check.Equals, "failed to generate the archive in 3 attempts")
+	n, err := sess.Collection(jobsCollectionName).FindId(archive.ID).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// waitPollInterval is the interval in which archives are checked again while
+// waiting for them, as archives built by other instances of the server are
+// not notified.
+const waitPollInterval = 2 * time.Second
+
+var (
+	archiveWatchersMutex sync.Mutex
+	archiveWatchers      = make(map[string][]chan struct{})
+)
+
+// watchArchive returns a channel that is closed on the next change of status
+// of the archive, and a function that stops watching it.
+func watchArchive(id string) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	archiveWatchersMutex.Lock()
+	archiveWatchers[id] = append(archiveWatchers[id], ch)
+	archiveWatchersMutex.Unlock()
+	return ch, func() {
+		archiveWatchersMutex.Lock()
+		defer archiveWatchersMutex.Unlock()
+		watchers := archiveWatchers[id]
+		for i, watcher := range watchers {
+			if watcher == ch {
+				watchers = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+		if len(watchers) == 0 {
+			delete(archiveWatchers, id)
+		} else {
+			archiveWatchers[id] = watchers
+		}
+	}
+}
+
+// notifyArchive notifies the watchers of an archive that its status has
+// changed.
+func notifyArchive(id string) {
+	archiveWatchersMutex.Lock()
+	defer archiveWatchersMutex.Unlock()
+	for _, ch := range archiveWatchers[id] {
+		close(ch)
+	}
+	delete(archiveWatchers, id)
+}
+
+// WaitArchive returns the archive once it leaves StatusBuilding, or its
+// current state when the timeout expires or done is closed.
+func WaitArchive(id string, timeout time.Duration, done <-chan struct{}) (*Archive, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		changed, stop := watchArchive(id)
+		archive, err := GetArchive(id)
+		if err != nil || archive.Status != StatusBuilding {
+			stop()
+			return archive, err
+		}
+		poll := time.NewTimer(waitPollInterval)
+		expired := false
+		select {
+		case <-changed:
+		case <-poll.C:
+		case <-deadline.C:
+			expired = true
+		case <-done:
+			expired = true
+		}
+		poll.Stop()
+		stop()
+		if expired {
+			return archive, nil
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (Suite) TestWaitArchive(c *check.C) {
+	archive := Archive{ID: "archive to wait", Status: StatusBuilding}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		db.UpdateStatus(archive.ID, StatusReady, "")
+		notifyArchive(archive.ID)
+	}()
+	start := time.Now()
+	got, err := WaitArchive(archive.ID, 10*time.Second, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(got.Status, check.Equals, StatusReady)
+	c.Assert(time.Since(start) < waitPollInterval, check.Equals, true)
+	archiveWatchersMutex.Lock()
+	defer archiveWatchersMutex.Unlock()
+	c.Assert(archiveWatchers, check.HasLen, 0)
+}
+
+func (Suite) TestWaitArchiveTimeout(c *check.C) {
+	archive := Archive{ID: "archive to wait forever", Status: StatusBuilding}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	got, err := WaitArchive(archive.ID, 50*time.Millisecond, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(got.Status, check.Equals, StatusBuilding)
+	done := make(chan struct{})
+	close(done)
+	got, err = WaitArchive(archive.ID, time.Minute, done)
+	c.Assert(err, check.IsNil)
+	c.Assert(got.Status, check.Equals, StatusBuilding)
+	_, err = WaitArchive("unknown", time.Minute, nil)
+	c.Assert(err, check.Equals, ErrArchiveNotFound)
+}
@@ -0,0 +1,237 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+func hasWildcard(spec string) bool {
+	return strings.ContainsAny(spec, "*?[")
+}
+
+// validatePathspecs checks the pathspecs of the paths included in and
+// excluded from an archive. Pathspecs are relative to the root of the
+// repository, and can't use the magic signatures of git. Stripping requires
+// a single path, the directory that becomes the root of the archive.
+func validatePathspecs(paths, exclude []string, strip bool) error {
+	for _, spec := range append(paths, exclude...) {
+		clean := strings.TrimSuffix(spec, "/")
+		if clean == "" || strings.HasPrefix(spec, "/") || strings.HasPrefix(spec, ":") {
+			return fmt.Errorf("invalid path %q", spec)
+		}
+		for _, part := range strings.Split(clean, "/") {
+			if part == "" || part == "." || part == ".." {
+				return fmt.Errorf("invalid path %q", spec)
+			}
+		}
+		if _, err := wildcardRegexp(clean); err != nil {
+			return fmt.Errorf("invalid path %q", spec)
+		}
+	}
+	if strip && (len(paths) != 1 || hasWildcard(paths[0])) {
+		return fmt.Errorf("strip requires a single directory in paths")
+	}
+	return nil
+}
+
+// wildcardTokens splits a pathspec in its wildcards, bracket expressions
+// and characters.
+func wildcardTokens(spec string) []string {
+	var tokens []string
+	for i := 0; i < len(spec); {
+		if spec[i] == '[' {
+			if end := strings.IndexByte(spec[i+1:], ']'); end >= 1 {
+				tokens = append(tokens, spec[i:i+end+2])
+				i += end + 2
+				continue
+			}
+		}
+		_, size := utf8.DecodeRuneInString(spec[i:])
+		tokens = append(tokens, spec[i:i+size])
+		i += size
+	}
+	return tokens
+}
+
+func tokenExpr(token string) string {
+	switch {
+	case token == "*":
+		return ".*"
+	case token == "?":
+		return "."
+	case len(token) > 2 && token[0] == '[':
+		class := token[1 : len(token)-1]
+		if class[0] == '!' {
+			class = "^" + class[1:]
+		}
+		return "[" + strings.Replace(class, `\`, `\\`, -1) + "]"
+	}
+	return regexp.QuoteMeta(token)
+}
+
+// wildcardRegexp converts a pathspec with wildcards to a regular expression.
+// As in git, wildcards match slashes.
+func wildcardRegexp(spec string) (*regexp.Regexp, error) {
+	expr := "(?s)^"
+	for _, token := range wildcardTokens(spec) {
+		expr += tokenExpr(token)
+	}
+	return regexp.Compile(expr + "$")
+}
+
+// rebasePathspec returns the pathspecs, relative to dir, that match the
+// paths inside dir matched by spec. As wildcards may match any part of dir,
+// there may be more than one. A spec that matches dir or one of its parents
+// excludes all of its content, and is rebased to "*".
+func rebasePathspec(spec, dir string) []string {
+	tokens := wildcardTokens(strings.TrimSuffix(spec, "/"))
+	// states holds the positions in tokens reachable after matching a
+	// prefix of dir, where a "*" may also match nothing.
+	states := make([]bool, len(tokens)+1)
+	closure := func() {
+		for i, token := range tokens {
+			if states[i] && token == "*" {
+				states[i+1] = true
+			}
+		}
+	}
+	states[0] = true
+	closure()
+	for _, r := range dir + "/" {
+		if r == '/' && states[len(tokens)] {
+			return []string{"*"}
+		}
+		next := make([]bool, len(tokens)+1)
+		for i, token := range tokens {
+			if !states[i] {
+				continue
+			}
+			switch {
+			case token == "*":
+				next[i] = true
+			case token == "?" || token == string(r):
+				next[i+1] = true
+			case len(token) > 2 && token[0] == '[':
+				if class, err := regexp.Compile(tokenExpr(token)); err == nil && class.MatchString(string(r)) {
+					next[i+1] = true
+				}
+			}
+		}
+		states = next
+		closure()
+	}
+	var specs []string
+	for i := range tokens {
+		if i > 0 && states[i-1] && tokens[i-1] == "*" {
+			continue // the spec with the "*" matches the same paths
+		}
+		if rest := strings.Join(tokens[i:], ""); states[i] && !strings.HasPrefix(rest, "/") {
+			specs = append(specs, rest)
+		}
+	}
+	return specs
+}
+
+// pathspec matches a path and, for pathspecs without wildcards, the paths
+// inside it. For pathspecs with wildcards, literal is the part before the
+// first wildcard.
+type pathspec struct {
+	literal string
+	pattern *regexp.Regexp
+}
+
+func compilePathspec(spec string) pathspec {
+	spec = strings.TrimSuffix(spec, "/")
+	if hasWildcard(spec) {
+		if pattern, err := wildcardRegexp(spec); err == nil {
+			literal := spec[:strings.IndexAny(spec, "*?[")]
+			return pathspec{literal: literal, pattern: pattern}
+		}
+	}
+	return pathspec{literal: spec}
+}
+
+func (p pathspec) matches(name string) bool {
+	if p.pattern != nil {
+		return p.pattern.MatchString(name)
+	}
+	return name == p.literal || strings.HasPrefix(name, p.literal+"/")
+}
+
+// pathFilter selects the paths of a tree included in an archive. Without
+// include pathspecs, all paths not excluded are included.
+type pathFilter struct {
+	include []pathspec
+	exclude []pathspec
+}
+
+func newPathFilter(paths, exclude []string) pathFilter {
+	var filter pathFilter
+	for _, spec := range paths {
+		filter.include = append(filter.include, compilePathspec(spec))
+	}
+	for _, spec := range exclude {
+		filter.exclude = append(filter.exclude, compilePathspec(spec))
+	}
+	return filter
+}
+
+func (f pathFilter) included(name string) bool {
+	for _, spec := range f.exclude {
+		if spec.matches(name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, spec := range f.include {
+		if spec.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayContain reports whether the directory may contain included paths.
+func (f pathFilter) mayContain(dir string) bool {
+	for _, spec := range f.exclude {
+		if spec.matches(dir) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, spec := range f.include {
+		if spec.pattern != nil && strings.HasPrefix(dir+"/", spec.literal) {
+			return true
+		}
+		if spec.matches(dir) || strings.HasPrefix(spec.literal, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// archivePaths returns the directory of the repository that becomes the
+// root of the archive, which is empty unless Strip is set, and the
+// pathspecs relative to it. Excluded paths outside the directory are
+// dropped.
+func (source *GitSource) archivePaths() (string, []string, []string) {
+	if !source.Strip || len(source.Paths) != 1 {
+		return "", source.Paths, source.Exclude
+	}
+	dir := strings.TrimSuffix(source.Paths[0], "/")
+	var exclude []string
+	for _, spec := range source.Exclude {
+		exclude = append(exclude, rebasePathspec(spec, dir)...)
+	}
+	return dir, nil, exclude
+}
@@ -0,0 +1,182 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (Suite) TestValidatePathspecs(c *check.C) {
+	var tests = []struct {
+		paths   []string
+		exclude []string
+		strip   bool
+		err     string
+	}{
+		{nil, nil, false, ""},
+		{[]string{"services/api", "lib/*.go"}, []string{"docs/"}, false, ""},
+		{[]string{"services/api/"}, []string{"services/api/test"}, true, ""},
+		{[]string{"/etc"}, nil, false, `invalid path "/etc"`},
+		{[]string{"../other"}, nil, false, `invalid path "../other"`},
+		{[]string{"a/./b"}, nil, false, `invalid path "a/./b"`},
+		{nil, []string{":(top)a"}, false, `invalid path ":\(top\)a"`},
+		{[]string{"[z-a]"}, nil, false, `invalid path "\[z-a\]"`},
+		{nil, nil, true, "strip requires a single directory in paths"},
+		{[]string{"a", "b"}, nil, true, "strip requires a single directory in paths"},
+		{[]string{"services/*"}, nil, true, "strip requires a single directory in paths"},
+	}
+	for _, t := range tests {
+		err := validatePathspecs(t.paths, t.exclude, t.strip)
+		if t.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, t.err)
+		}
+	}
+}
+
+func (Suite) TestPathFilter(c *check.C) {
+	filter := newPathFilter([]string{"services/api", "lib/*.go", "README"}, []string{"services/api/test", "*.log"})
+	var tests = []struct {
+		name       string
+		included   bool
+		mayContain bool
+	}{
+		{"README", true, true},
+		{"README.md", false, false},
+		{"services", false, true},
+		{"services/api", true, true},
+		{"services/api/main.go", true, true},
+		{"services/api/debug.log", false, false},
+		{"services/api/test", false, false},
+		{"services/api/test/main_test.go", false, false},
+		{"services/web", false, false},
+		{"lib/a.go", true, true},
+		{"lib/sub/b.go", true, true},
+		{"lib/a.c", false, true},
+		{"docs", false, false},
+	}
+	for _, t := range tests {
+		c.Check(filter.included(t.name), check.Equals, t.included, check.Commentf("%s", t.name))
+		c.Check(filter.mayContain(t.name), check.Equals, t.mayContain, check.Commentf("%s", t.name))
+	}
+	filter = newPathFilter(nil, []string{"docs"})
+	c.Check(filter.included("README"), check.Equals, true)
+	c.Check(filter.included("docs/index.md"), check.Equals, false)
+	c.Check(filter.mayContain("docs"), check.Equals, false)
+}
+
+func (Suite) TestArchivePaths(c *check.C) {
+	source := GitSource{Paths: []string{"services/api/"}, Exclude: []string{"services/api/test", "docs"}}
+	dir, paths, exclude := source.archivePaths()
+	c.Assert(dir, check.Equals, "")
+	c.Assert(paths, check.DeepEquals, source.Paths)
+	c.Assert(exclude, check.DeepEquals, source.Exclude)
+	source.Strip = true
+	dir, paths, exclude = source.archivePaths()
+	c.Assert(dir, check.Equals, "services/api")
+	c.Assert(paths, check.HasLen, 0)
+	c.Assert(exclude, check.DeepEquals, []string{"test"})
+	source.Exclude = []string{"*.md", "services/*/test", "docs"}
+	_, _, exclude = source.archivePaths()
+	c.Assert(exclude, check.DeepEquals, []string{"*.md", "*/test", "test"})
+}
+
+func (Suite) TestRebasePathspec(c *check.C) {
+	var tests = []struct {
+		spec  string
+		specs []string
+	}{
+		{"services/api/test", []string{"test"}},
+		{"services/api/test/", []string{"test"}},
+		{"docs", nil},
+		{"services/web/*.md", nil},
+		{"*.md", []string{"*.md"}},
+		{"services/api/*.md", []string{"*.md"}},
+		{"services/a?i/*.log", []string{"*.log"}},
+		{"services/[a-c]pi/test", []string{"test"}},
+		{"services/[!a]pi/test", nil},
+		{"*/test", []string{"*/test", "test"}},
+		{"services", []string{"*"}},
+		{"services/api", []string{"*"}},
+		{"serv*", []string{"*"}},
+	}
+	for _, t := range tests {
+		c.Check(rebasePathspec(t.spec, "services/api"), check.DeepEquals, t.specs, check.Commentf("%s", t.spec))
+	}
+}
+
+// withoutTimes drops the global header and the times of the entries of a
+// tar, which git archive sets to the current time for trees.
+func withoutTimes(entries []string) []string {
+	var result []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry, "pax_global_header ") {
+			result = append(result, entry[:strings.LastIndex(entry, " ")])
+		}
+	}
+	return result
+}
+
+func (Suite) TestArchiverPaths(c *check.C) {
+	dir := c.MkDir()
+	work := filepath.Join(dir, "work")
+	gitCommand(c, dir, "init", "-q", work)
+	files := []string{
+		"README",
+		"services/api/main.go",
+		"services/api/README.md",
+		"services/api/debug.log",
+		"services/api/test/main_test.go",
+		"services/web/index.html",
+		"lib/a.go",
+		"lib/a.c",
+		"lib/sub/b.go",
+		"docs/index.md",
+	}
+	for _, name := range files {
+		path := filepath.Join(work, name)
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), check.IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte(name+"\n"), 0644), check.IsNil)
+	}
+	gitCommand(c, work, "add", ".")
+	gitCommand(c, work, "commit", "-q", "-m", "first")
+	var tests = []GitSource{
+		{Paths: []string{"services/api"}},
+		{Paths: []string{"services/api/", "lib/*.go", "README"}, Exclude: []string{"services/api/test", "*.log"}},
+		{Exclude: []string{"docs", "services/web"}},
+		{Paths: []string{"services"}, Exclude: []string{"services/*/*.html"}},
+		{Paths: []string{"services/api"}, Exclude: []string{"services/api/test", "docs"}, Strip: true},
+		{Paths: []string{"services/api"}, Exclude: []string{"*.md", "services/*/test"}, Strip: true},
+	}
+	defer func() { gitArchiver = "command" }()
+	for _, source := range tests {
+		source.Repository = work
+		archive := Archive{ID: "test", Source: &source, Format: FormatTar}
+		var entries [2][]string
+		for i, archiver := range []string{"command", "native"} {
+			gitArchiver = archiver
+			var stdout, stderr bytes.Buffer
+			err := archive.archiver("app/", "master")(&stdout, &stderr)
+			c.Assert(err, check.IsNil, check.Commentf("%s", stderr.String()))
+			entries[i] = tarEntries(c, &stdout)
+		}
+		if source.Strip {
+			entries[0], entries[1] = withoutTimes(entries[0]), withoutTimes(entries[1])
+			excluded := newPathFilter(nil, source.Exclude)
+			for _, entry := range entries[1] {
+				name := strings.TrimSuffix(source.Paths[0]+"/"+strings.TrimPrefix(strings.Fields(entry)[0], "app/"), "/")
+				c.Check(excluded.included(name), check.Equals, true, check.Commentf("%s", name))
+			}
+		}
+		c.Check(entries[1], check.DeepEquals, entries[0], check.Commentf("%#v", source))
+	}
+}
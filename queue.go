@@ -0,0 +1,179 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when the generation queue does not accept
+	// more archives.
+	ErrQueueFull = errors.New("generation queue is full")
+
+	// ErrQueueClosed is returned when archives are enqueued while the
+	// queue is being drained.
+	ErrQueueClosed = errors.New("generation queue is closed")
+)
+
+// GenerationQueue holds the archives waiting to be generated from git.
+type GenerationQueue interface {
+	// Enqueue adds the archive to the queue, returning ErrQueueFull when
+	// the queue does not accept more archives.
+	Enqueue(archive Archive, store BlobStore, db ArchiveStore) error
+
+	// Position returns the position of the archive in the queue, starting
+	// at 1, or 0 when the archive is not waiting in the queue.
+	Position(id string) int
+
+	// Drain stops taking archives from the queue and waits for the
+	// archives being generated by this instance, up to the given timeout.
+	// It returns false when the timeout is reached first.
+	Drain(timeout time.Duration) bool
+}
+
+var (
+	queueMutex sync.Mutex
+	queue      GenerationQueue
+)
+
+// jobQueue returns the queue of archives waiting for generation, which is
+// created on the first use. With the -shared-queue flag, the queue is kept
+// in the database and shared by all the write servers.
+func jobQueue() GenerationQueue {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	if queue == nil {
+		if sharedQueue {
+			workers := generationWorkers
+			if writeHttp == "" {
+				workers = 0
+			}
+			queue = NewMongoJobQueue(workers, queueSize, buildLease)
+		} else {
+			queue = NewJobQueue(generationWorkers, queueSize)
+		}
+	}
+	return queue
+}
+
+// checkSharedQueue returns an error when the -shared-queue flag is set
+// without the backends it requires. Any server may generate any archive in
+// the shared queue, so the metadata must be in MongoDB and the contents in
+// a storage that all the servers reach.
+func checkSharedQueue() error {
+	if !sharedQueue {
+		return nil
+	}
+	if metadataBackend != "mongodb" {
+		return fmt.Errorf("-shared-queue requires the mongodb metadata backend, not %s", metadataBackend)
+	}
+	if storageBackend != "s3" && storageBackend != "gridfs" {
+		return fmt.Errorf("-shared-queue requires the s3 or gridfs storage backend, not %s", storageBackend)
+	}
+	return nil
+}
+
+type job struct {
+	archive Archive
+	store   BlobStore
+	stop    func()
+}
+
+// JobQueue is a GenerationQueue kept in memory, which generates archives
+// from git in a bounded number of workers. The archives wait in the queue,
+// up to its size, for a free worker.
+type JobQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []job
+	size    int
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// NewJobQueue starts a queue with the given number of workers, which holds
+// up to size archives waiting for generation.
+func NewJobQueue(workers, size int) *JobQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := JobQueue{size: size}
+	q.cond = sync.NewCond(&q.mu)
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return &q
+}
+
+// Enqueue adds the archive to the queue. While the archive waits and is
+// generated, its heartbeat is kept in the store.
+func (q *JobQueue) Enqueue(archive Archive, store BlobStore, db ArchiveStore) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if len(q.pending) >= q.size {
+		return ErrQueueFull
+	}
+	q.pending = append(q.pending, job{archive: archive, store: store, stop: archive.keepAlive(db)})
+	q.cond.Signal()
+	return nil
+}
+
+func (q *JobQueue) work() {
+	defer q.workers.Done()
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		j := q.pending[0]
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+		j.archive.generate(j.store)
+		j.stop()
+	}
+}
+
+func (q *JobQueue) Position(id string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, j := range q.pending {
+		if j.archive.ID == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Drain stops accepting archives and waits for all the archives in the
+// queue to be generated.
+func (q *JobQueue) Drain(timeout time.Duration) bool {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/tsuru/commandmocker"
+	"gopkg.in/check.v1"
+)
+
+// blockingStore is a LocalStore whose writes wait for release to be closed.
+type blockingStore struct {
+	*LocalStore
+	release chan struct{}
+}
+
+func (s blockingStore) Put(key string, r io.Reader) error {
+	<-s.release
+	return s.LocalStore.Put(key, r)
+}
+
+func (Suite) TestJobQueue(c *check.C) {
+	defer useIsolatedMetadata(c)()
+	tmpdir, err := commandmocker.Add("git", "success")
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(tmpdir)
+	store := blockingStore{LocalStore: NewLocalStore(baseDir), release: make(chan struct{})}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	path, _ := filepath.Abs("testdata/test.git")
+	var archives []Archive
+	for _, id := range []string{"queued1", "queued2", "queued3"} {
+		archive := Archive{
+			ID:     id,
+			Path:   id + ".tar.gz",
+			Status: StatusBuilding,
+			Source: &GitSource{Repository: path, Ref: "master", Prefix: "project"},
+		}
+		err = db.Insert(archive)
+		c.Assert(err, check.IsNil)
+		archives = append(archives, archive)
+		defer store.Delete(archive.Path)
+	}
+	q := NewJobQueue(1, 1)
+	err = q.Enqueue(archives[0], store, db)
+	c.Assert(err, check.IsNil)
+	wait(c, 3e9, func() bool { return q.Position(archives[0].ID) == 0 })
+	err = q.Enqueue(archives[1], store, db)
+	c.Assert(err, check.IsNil)
+	c.Assert(q.Position(archives[1].ID), check.Equals, 1)
+	err = q.Enqueue(archives[2], store, db)
+	c.Assert(err, check.Equals, ErrQueueFull)
+	close(store.release)
+	c.Assert(q.Drain(3*time.Second), check.Equals, true)
+	for _, archive := range archives[:2] {
+		got, err := db.Get(archive.ID)
+		c.Assert(err, check.IsNil)
+		c.Assert(got.Status, check.Equals, StatusReady)
+	}
+	err = q.Enqueue(archives[2], store, db)
+	c.Assert(err, check.Equals, ErrQueueClosed)
+}
+
+func (Suite) TestCheckSharedQueue(c *check.C) {
+	defer func(shared bool, metadata, storage string) {
+		sharedQueue, metadataBackend, storageBackend = shared, metadata, storage
+	}(sharedQueue, metadataBackend, storageBackend)
+	var tests = []struct {
+		shared   bool
+		metadata string
+		storage  string
+		err      string
+	}{
+		{false, "file", "local", ""},
+		{true, "mongodb", "s3", ""},
+		{true, "mongodb", "gridfs", ""},
+		{true, "mongodb", "local", "-shared-queue requires the s3 or gridfs storage backend, not local"},
+		{true, "file", "s3", "-shared-queue requires the mongodb metadata backend, not file"},
+	}
+	for _, t := range tests {
+		sharedQueue, metadataBackend, storageBackend = t.shared, t.metadata, t.storage
+		err := checkSharedQueue()
+		if t.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, t.err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// orphanGracePeriod is the minimum age of blobs removed as orphans, so blobs
+// that are still being written are never removed.
+const orphanGracePeriod = time.Hour
+
+// archiveKeyPattern matches the keys of the blobs of archives, with or
+// without extension, including the temporary files written by LocalStore.
+// Other blobs are never removed.
+var archiveKeyPattern = regexp.MustCompile(`^\.?[0-9a-f]{128}(\.|$)`)
+
+// ReconcileReport describes the inconsistencies found between the metadata
+// of the archives and their contents.
+type ReconcileReport struct {
+	// Orphans are the keys of the blobs that do not belong to any archive.
+	Orphans []string
+
+	// Missing are the IDs of the ready archives whose content is missing.
+	Missing []string
+}
+
+// persistentMetadata reports whether the metadata of the archives survives
+// restarts of the server. Without it, every blob of a previous run would
+// look like an orphan.
+func persistentMetadata() bool {
+	return metadataBackend != "memory"
+}
+
+// Reconcile compares the archives with the blobs in the store. Orphan blobs
+// are removed, and ready archives whose content is missing are marked as
+// failed. When dryRun is true, nothing is changed. Orphan blobs are only
+// detected in stores that implement BlobLister, and when the metadata is
+// persistent.
+func Reconcile(store BlobStore, dryRun bool) (*ReconcileReport, error) {
+	// Blobs are listed before the archives, as archives are always
+	// inserted before their content is saved.
+	var blobs []BlobInfo
+	if lister, ok := store.(BlobLister); ok && persistentMetadata() {
+		var err error
+		blobs, err = lister.List()
+		if err != nil {
+			return nil, err
+		}
+	}
+	db, err := archiveStore()
+	if err != nil {
+		return nil, err
+	}
+	archives, err := db.List(ArchiveQuery{})
+	if err != nil {
+		return nil, err
+	}
+	var report ReconcileReport
+	referenced := make(map[string]bool, len(archives))
+	for _, archive := range archives {
+		if archive.Status == StatusDestroyed {
+			continue
+		}
+		referenced[filepath.Base(archive.Path)] = true
+		for format := range formats {
+			referenced[filepath.Base(variantKey(&archive, format))] = true
+		}
+		if archive.Status != StatusReady {
+			continue
+		}
+		_, err = store.Stat(archive.Path)
+		if err == ErrBlobNotFound {
+			// The archive may have been destroyed after it was listed,
+			// so it is only marked as failed while it is still ready.
+			missing := true
+			err = nil
+			if !dryRun {
+				missing, err = db.UpdateStatusIf(archive.ID, StatusReady, StatusError, "archive content is missing")
+			}
+			if missing {
+				report.Missing = append(report.Missing, archive.ID)
+			}
+			if missing && !dryRun {
+				log.Printf("[INFO] Marked archive %q as failed: its content is missing", archive.ID)
+				notifyArchive(archive.ID)
+			}
+		}
+		if err != nil {
+			return &report, err
+		}
+	}
+	limit := time.Now().Add(-orphanGracePeriod)
+	for _, blob := range blobs {
+		if referenced[blob.Key] || !archiveKeyPattern.MatchString(blob.Key) || blob.ModTime.After(limit) {
+			continue
+		}
+		report.Orphans = append(report.Orphans, blob.Key)
+		if dryRun {
+			continue
+		}
+		log.Printf("[INFO] Removing orphan archive content %q", blob.Key)
+		err = store.Delete(blob.Key)
+		if err != nil && err != ErrBlobNotFound {
+			return &report, err
+		}
+	}
+	return &report, nil
+}
+
+// reconcileArchives reconciles the archives with the blob store right away
+// and then periodically.
+func reconcileArchives(interval time.Duration) {
+	for {
+		store, err := blobStore()
+		if err == nil {
+			_, err = Reconcile(store, false)
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to reconcile archives: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// fsck implements the fsck subcommand, which reconciles the archives once
+// and reports what it did. It returns the exit status of the command.
+func fsck(args []string, w io.Writer) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	flags.SetOutput(w)
+	dryRun := flags.Bool("n", false, "Report the inconsistencies without fixing them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	defer func(readOnly bool) { metadataReadOnly = readOnly }(metadataReadOnly)
+	metadataReadOnly = *dryRun
+	store, err := blobStore()
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	if !persistentMetadata() {
+		fmt.Fprintln(w, "the memory metadata backend is not persistent: orphan contents are not detected")
+	}
+	report, err := Reconcile(store, *dryRun)
+	if report != nil {
+		removed, failed := "removed", "marked as failed"
+		if *dryRun {
+			removed, failed = "not removed", "not changed"
+		}
+		for _, key := range report.Orphans {
+			fmt.Fprintf(w, "orphan content %s: %s\n", key, removed)
+		}
+		for _, id := range report.Missing {
+			fmt.Fprintf(w, "archive %s is missing its content: %s\n", id, failed)
+		}
+		fmt.Fprintf(w, "%d orphan contents, %d archives with missing content\n", len(report.Orphans), len(report.Missing))
+	}
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	return 0
+}
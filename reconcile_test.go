@@ -0,0 +1,143 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// useIsolatedMetadata makes the tests use an empty metadata store, and
+// returns a function that restores the previous store.
+func useIsolatedMetadata(c *check.C) func() {
+	oldBackend, oldFile := metadataBackend, metadataFile
+	metadataBackend, metadataFile = "file", filepath.Join(c.MkDir(), "metadata.json")
+	return func() { metadataBackend, metadataFile = oldBackend, oldFile }
+}
+
+func (Suite) TestReconcile(c *check.C) {
+	defer useIsolatedMetadata(c)()
+	dir := filepath.Join(baseDir, "reconcile")
+	err := os.MkdirAll(dir, 0755)
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	store := NewLocalStore(dir)
+	kept := Archive{ID: strings.Repeat("a", 128), Status: StatusReady}
+	missing := Archive{ID: strings.Repeat("b", 128), Status: StatusReady}
+	destroyed := Archive{ID: strings.Repeat("c", 128), Status: StatusDestroyed}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	for _, archive := range []*Archive{&kept, &missing, &destroyed} {
+		archive.Path = archive.ID + ".tar.gz"
+		db.Insert(*archive)
+		defer db.Delete(archive.ID)
+	}
+	old := time.Now().Add(-2 * orphanGracePeriod)
+	for _, key := range []string{kept.Path, destroyed.Path, strings.Repeat("d", 128) + ".tar.gz", strings.Repeat("e", 128) + ".tar.gz", "metadata.json"} {
+		err = store.Put(key, strings.NewReader("content"))
+		c.Assert(err, check.IsNil)
+		if !strings.HasPrefix(key, "e") {
+			os.Chtimes(filepath.Join(dir, key), old, old)
+		}
+	}
+	report, err := Reconcile(store, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.Orphans, check.DeepEquals, []string{destroyed.Path, strings.Repeat("d", 128) + ".tar.gz"})
+	c.Assert(report.Missing, check.DeepEquals, []string{missing.ID})
+	archive, err := db.Get(missing.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Status, check.Equals, StatusReady)
+	_, err = store.Stat(destroyed.Path)
+	c.Assert(err, check.IsNil)
+	report, err = Reconcile(store, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.Orphans, check.HasLen, 2)
+	archive, err = db.Get(missing.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Status, check.Equals, StatusError)
+	c.Assert(archive.Log, check.Equals, "archive content is missing")
+	blobs, err := store.List()
+	c.Assert(err, check.IsNil)
+	var keys []string
+	for _, blob := range blobs {
+		keys = append(keys, blob.Key)
+	}
+	c.Assert(keys, check.DeepEquals, []string{kept.Path, strings.Repeat("e", 128) + ".tar.gz", "metadata.json"})
+}
+
+func (Suite) TestFsck(c *check.C) {
+	defer useIsolatedMetadata(c)()
+	archive := Archive{ID: "fsck archive", Path: "fsck-missing.tar.gz", Status: StatusReady}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	data, err := ioutil.ReadFile(metadataFile)
+	c.Assert(err, check.IsNil)
+	var buf bytes.Buffer
+	c.Assert(fsck([]string{"-n"}, &buf), check.Equals, 0)
+	c.Assert(buf.String(), check.Matches, `(?s).*archive fsck archive is missing its content: not changed\n.*`)
+	got, err := ioutil.ReadFile(metadataFile)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(got), check.Equals, string(data))
+	buf.Reset()
+	c.Assert(fsck(nil, &buf), check.Equals, 0)
+	c.Assert(buf.String(), check.Matches, `(?s).*archive fsck archive is missing its content: marked as failed\n.*`)
+	c.Assert(fsck([]string{"-unknown"}, &buf), check.Equals, 2)
+}
+
+// destroyingStore is a LocalStore where the archive is destroyed right
+// before its content is looked up.
+type destroyingStore struct {
+	*LocalStore
+	id string
+}
+
+func (s destroyingStore) Stat(key string) (BlobInfo, error) {
+	db, err := archiveStore()
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	db.UpdateStatus(s.id, StatusDestroyed, "")
+	return s.LocalStore.Stat(key)
+}
+
+func (Suite) TestReconcileDestroyedArchive(c *check.C) {
+	defer useIsolatedMetadata(c)()
+	archive := Archive{ID: strings.Repeat("f", 128), Path: strings.Repeat("f", 128) + ".tar.gz", Status: StatusReady}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	report, err := Reconcile(destroyingStore{LocalStore: NewLocalStore(c.MkDir()), id: archive.ID}, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.Missing, check.HasLen, 0)
+	gotArchive, err := db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(gotArchive.Status, check.Equals, StatusDestroyed)
+}
+
+func (Suite) TestReconcileMemoryMetadata(c *check.C) {
+	oldBackend := metadataBackend
+	metadataBackend = "memory"
+	defer func() { metadataBackend = oldBackend }()
+	dir := c.MkDir()
+	store := NewLocalStore(dir)
+	key := strings.Repeat("d", 128) + ".tar.gz"
+	err := store.Put(key, strings.NewReader("content"))
+	c.Assert(err, check.IsNil)
+	old := time.Now().Add(-2 * orphanGracePeriod)
+	os.Chtimes(filepath.Join(dir, key), old, old)
+	report, err := Reconcile(store, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.Orphans, check.HasLen, 0)
+	_, err = store.Stat(key)
+	c.Assert(err, check.IsNil)
+}
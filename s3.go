@@ -0,0 +1,327 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3DateFormat     = "20060102T150405Z"
+	s3EmptyPayload   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3SigningService = "s3"
+)
+
+// s3Timeout bounds connecting to the object storage and waiting for the
+// headers of its responses. Bodies have no deadline, as blobs may be large.
+var s3Timeout = 30 * time.Second
+
+// S3Store is a BlobStore that keeps blobs in a bucket of an S3-compatible
+// object storage. Requests are signed with AWS Signature Version 4 and use
+// path-style addressing, so it works with any endpoint that implements the
+// S3 API.
+type S3Store struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// NewS3Store returns an S3Store that stores blobs in the given bucket.
+// endpoint is the base URL of the object storage (for example,
+// https://s3.amazonaws.com).
+func NewS3Store(endpoint, bucket, region, accessKey, secretKey string) *S3Store {
+	return &S3Store{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    newS3Client(s3Timeout),
+	}
+}
+
+// newS3Client returns a client that gives up on endpoints that stall before
+// responding, instead of hanging downloads and generation forever.
+func newS3Client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   timeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   16,
+		},
+	}
+}
+
+// Put spools the content to a temporary file before sending it, because the
+// object storage requires the length and the digest of the payload upfront.
+func (s *S3Store) Put(key string, r io.Reader) error {
+	tmp, err := ioutil.TempFile("", "archive-server-s3")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Seek(0, 0); err != nil {
+		return err
+	}
+	req, err := s.newRequest("PUT", key, tmp, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError(key, resp)
+	}
+	return nil
+}
+
+func (s *S3Store) Get(key string) (Blob, error) {
+	object := &s3Object{store: s, key: key}
+	resp, err := object.get()
+	if err != nil {
+		return nil, err
+	}
+	object.body = resp.Body
+	object.size = resp.ContentLength
+	if object.size < 0 {
+		// The length is unknown when the server answers with a chunked
+		// encoding, so it is taken from the metadata of the object.
+		info, err := s.Stat(key)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		object.size = info.Size
+	}
+	return object, nil
+}
+
+func (s *S3Store) Delete(key string) error {
+	req, err := s.newRequest("DELETE", key, nil, s3EmptyPayload)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s.responseError(key, resp)
+	}
+	return nil
+}
+
+func (s *S3Store) Stat(key string) (BlobInfo, error) {
+	req, err := s.newRequest("HEAD", key, nil, s3EmptyPayload)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return BlobInfo{}, s.responseError(key, resp)
+	}
+	if resp.ContentLength < 0 {
+		return BlobInfo{}, fmt.Errorf("s3: HEAD %q: unknown size", key)
+	}
+	info := BlobInfo{Key: key, Size: resp.ContentLength}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+// s3Object is an object opened for reading. Seeking closes the current
+// response, and the next read requests the object from the new offset
+// using a ranged request.
+type s3Object struct {
+	store  *S3Store
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) get() (*http.Response, error) {
+	req, err := o.store.newRequest("GET", o.key, nil, s3EmptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	// Transparent decompression would change the length and the offsets
+	// of the content.
+	req.Header.Set("Accept-Encoding", "identity")
+	expected := http.StatusOK
+	if o.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", o.offset))
+		expected = http.StatusPartialContent
+	}
+	resp, err := o.store.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expected {
+		defer resp.Body.Close()
+		return nil, o.store.responseError(o.key, resp)
+	}
+	return resp, nil
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		resp, err := o.get()
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return o.offset, errors.New("s3: negative position")
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
+
+func (s *S3Store) responseError(key string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrBlobNotFound
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %s %q: %s: %s", resp.Request.Method, key, resp.Status, bytes.TrimSpace(body))
+}
+
+// newRequest creates a signed request for the given key. payloadHash is the
+// hex encoded SHA-256 of the request body.
+func (s *S3Store) newRequest(method, key string, body io.Reader, payloadHash string) (*http.Request, error) {
+	path := "/" + s3EscapePath(s.bucket+"/"+strings.TrimPrefix(key, "/"))
+	req, err := http.NewRequest(method, s.endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, path, payloadHash, time.Now().UTC())
+	return req, nil
+}
+
+func (s *S3Store) sign(req *http.Request, path, payloadHash string, now time.Time) {
+	date := now.Format(s3DateFormat)
+	day := date[:8]
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           date,
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.region + "/" + s3SigningService + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s3SigningService)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath escapes path according to the URI encoding rules of the
+// signature version 4, preserving the slashes.
+func s3EscapePath(path string) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(path) {
+		if b == '/' || b == '-' || b == '_' || b == '.' || b == '~' ||
+			('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') || ('0' <= b && b <= '9') {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
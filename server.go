@@ -5,35 +5,115 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/tsuru/tsuru/db/storage"
 	"gopkg.in/tylerb/graceful.v1"
 )
 
 const version = "0.2.1"
 
+// maxFormValueSize is the maximum size of a form value that precedes the
+// archive file in multipart uploads.
+const maxFormValueSize = 64 << 10
+
+// buildingRetryAfter is the number of seconds clients are asked to wait
+// before requesting again the content of an archive that is being built.
+const buildingRetryAfter = "5"
+
+// queueRetryAfter is the number of seconds clients are asked to wait before
+// creating an archive again when the generation queue is full.
+const queueRetryAfter = "30"
+
+// maxStatusWait is the maximum time a client may wait for an archive to be
+// built in a single request.
+const maxStatusWait = 2 * time.Minute
+
+// eventsKeepAlive is the interval of the comments sent in event streams to
+// keep the connection alive while the archive is being built.
+const eventsKeepAlive = 15 * time.Second
+
+// defaultListLimit and maxListLimit are the default and maximum number of
+// archives returned in each page of the listing.
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
 var (
-	databaseAddr string
-	databaseName string
-	baseDir      string
-	readHttp     string
-	writeHttp    string
-	checkVersion bool
+	databaseAddr      string
+	databaseName      string
+	metadataBackend   string
+	metadataFile      string
+	baseDir           string
+	storageBackend    string
+	gridFSPrefix      string
+	s3Endpoint        string
+	s3Bucket          string
+	s3Region          string
+	s3AccessKey       string
+	s3SecretKey       string
+	readHttp          string
+	writeHttp         string
+	uploadDir         string
+	uploadTTL         time.Duration
+	maxDownloads      int
+	archiveTTL        time.Duration
+	purgeAfter        time.Duration
+	buildLease        time.Duration
+	generationWorkers int
+	sharedQueue       bool
+	queueSize         int
+	transcodeCache    bool
+	gitArchiver       string
+	mirrorDir         string
+	mirrorTTL         time.Duration
+	checkVersion      bool
 )
 
 func init() {
 	flag.StringVar(&databaseAddr, "mongodb", "127.0.0.1:27017", "Address of the database server")
 	flag.StringVar(&databaseName, "dbname", "archives", "Name of the database to store information about archives")
+	flag.StringVar(&metadataBackend, "metadata-backend", "mongodb", "Backend for the metadata of the archives: mongodb, memory or file")
+	flag.StringVar(&metadataFile, "metadata-file", "/var/lib/archives/metadata.json", "File where the file metadata backend stores information about archives")
 	flag.StringVar(&baseDir, "dir", "/var/lib/archives/", "Base directory, where the server will create and serve the archives")
+	flag.StringVar(&uploadDir, "upload-dir", "/var/lib/archives/uploads", "Directory where the server keeps the content of resumable uploads")
+	flag.DurationVar(&uploadTTL, "upload-ttl", 24*time.Hour, "Time after which resumable uploads that do not receive any content are removed")
+	flag.IntVar(&maxDownloads, "max-downloads", 1, "Default number of times an archive may be downloaded before being destroyed")
+	flag.DurationVar(&archiveTTL, "ttl", 7*24*time.Hour, "Default time after which archives expire and are destroyed. Use 0 to keep them forever")
+	flag.DurationVar(&purgeAfter, "purge-after", 7*24*time.Hour, "Time after which the records of destroyed and failed archives are removed. Use 0 to keep them forever")
+	flag.DurationVar(&buildLease, "build-lease", 2*time.Minute, "Time without heartbeats after which an archive being built is considered abandoned by its server and is generated again or marked as failed")
+	flag.IntVar(&generationWorkers, "workers", 4, "Number of archives generated from git at the same time")
+	flag.IntVar(&queueSize, "queue-size", 100, "Maximum number of archives waiting for generation, after which new archives are rejected")
+	flag.BoolVar(&sharedQueue, "shared-queue", false, "Share the generation queue between the write servers through MongoDB. Requires the mongodb metadata backend, the s3 or gridfs storage backend and repositories reachable from every server")
+	flag.StringVar(&gitArchiver, "git-archiver", "command", "How archives are generated from git repositories: command, which runs git archive, or native, which reads the repositories without the git command, falling back to git archive for repositories it can't read")
+	flag.StringVar(&mirrorDir, "mirror-dir", "/var/lib/archives/mirrors", "Directory where the server keeps the mirrors of remote repositories")
+	flag.DurationVar(&mirrorTTL, "mirror-ttl", 24*time.Hour, "Time after which mirrors of remote repositories that are not used are removed")
+	flag.BoolVar(&transcodeCache, "transcode-cache", false, "Save the archives converted to other formats when downloaded, so they are converted only once")
+	flag.StringVar(&storageBackend, "storage", "local", "Storage backend for the contents of the archives: local, s3 or gridfs")
+	flag.StringVar(&gridFSPrefix, "gridfs-prefix", "archives", "Prefix of the GridFS bucket where the gridfs storage backend stores the archives")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "Endpoint of the S3-compatible object storage, used by the s3 storage backend")
+	flag.StringVar(&s3Bucket, "s3-bucket", "archives", "Bucket where the s3 storage backend stores the archives")
+	flag.StringVar(&s3Region, "s3-region", "us-east-1", "Region of the S3-compatible object storage")
+	flag.StringVar(&s3AccessKey, "s3-access-key", "", "Access key for the S3-compatible object storage")
+	flag.StringVar(&s3SecretKey, "s3-secret-key", "", "Secret key for the S3-compatible object storage")
 	flag.StringVar(&readHttp, "read-http", "", "Address to bind the API that serves archives. Omit to not start this API.")
 	flag.StringVar(&writeHttp, "write-http", "", "Address to bind the API that creates archives. Omit to not start this API.")
 	flag.BoolVar(&checkVersion, "version", false, "Print version and exit")
@@ -43,24 +123,311 @@ func conn() (*storage.Storage, error) {
 	return storage.Open(databaseAddr, databaseName)
 }
 
+var (
+	embeddedMutex sync.Mutex
+	embeddedStore *MemoryStore
+	// metadataReadOnly makes the file metadata backend load a snapshot of
+	// the file instead of locking it, for commands that change nothing.
+	metadataReadOnly bool
+)
+
+func archiveStore() (ArchiveStore, error) {
+	switch metadataBackend {
+	case "mongodb":
+		return MongoStore{}, nil
+	case "memory", "file":
+		path := ""
+		if metadataBackend == "file" {
+			path = metadataFile
+		}
+		embeddedMutex.Lock()
+		defer embeddedMutex.Unlock()
+		if embeddedStore == nil || embeddedStore.path != path || embeddedStore.readOnly != (path != "" && metadataReadOnly) {
+			store := NewMemoryStore()
+			if path != "" {
+				var err error
+				if metadataReadOnly {
+					store, err = LoadFileStore(path)
+				} else {
+					store, err = NewFileStore(path)
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			if embeddedStore != nil {
+				embeddedStore.Close()
+			}
+			embeddedStore = store
+		}
+		return embeddedStore, nil
+	}
+	return nil, fmt.Errorf("unknown metadata backend %q", metadataBackend)
+}
+
+func blobStore() (BlobStore, error) {
+	switch storageBackend {
+	case "local":
+		return NewLocalStore(baseDir), nil
+	case "s3":
+		return NewS3Store(s3Endpoint, s3Bucket, s3Region, s3AccessKey, s3SecretKey), nil
+	case "gridfs":
+		return NewGridFSStore(gridFSPrefix), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", storageBackend)
+}
+
+// readRouter returns the handler of the API that serves archives.
+func readRouter() http.Handler {
+	router := newRouter()
+	router.HandleFunc("/v1/archives/{id}", archiveHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/v1/archives/{id}/content", archiveContentHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/v1/archives/{id}/events", archiveEventsHandler).Methods("GET")
+	// Compatibility alias, with the archive id in the query string.
+	router.HandleFunc("/", readArchiveHandler).Methods("GET", "HEAD")
+	return router
+}
+
+// writeRouter returns the handler of the API that creates archives. The
+// resumable upload protocol is:
+//
+//	POST   /v1/uploads             starts an upload, optionally with Upload-Length
+//	HEAD   /v1/uploads/{id}        returns the current Upload-Offset
+//	PATCH  /v1/uploads/{id}        appends a chunk at the given Upload-Offset
+//	POST   /v1/uploads/{id}/finish creates the archive from the upload
+//	DELETE /v1/uploads/{id}        cancels the upload
+func writeRouter() http.Handler {
+	router := newRouter()
+	router.HandleFunc("/v1/archives", createArchiveHandler).Methods("POST")
+	router.HandleFunc("/v1/archives", deleteArchivesHandler).Methods("DELETE")
+	router.HandleFunc("/v1/archives/{id}", deleteArchiveHandler).Methods("DELETE")
+	// Compatibility alias for the creation of archives.
+	router.HandleFunc("/", createArchiveHandler).Methods("POST")
+	// Routes below are also available without the version prefix, for
+	// compatibility.
+	for _, prefix := range []string{"/v1", ""} {
+		router.HandleFunc(prefix+"/archives", listArchivesHandler).Methods("GET")
+		router.HandleFunc(prefix+"/archives/{name:.+}", rawCreateArchiveHandler).Methods("PUT")
+		router.HandleFunc(prefix+"/uploads", createUploadHandler).Methods("POST")
+		router.HandleFunc(prefix+"/uploads/{id}", withUpload(uploadStatusHandler)).Methods("GET", "HEAD")
+		router.HandleFunc(prefix+"/uploads/{id}", withUpload(appendUploadHandler)).Methods("PATCH")
+		router.HandleFunc(prefix+"/uploads/{id}", withUpload(cancelUploadHandler)).Methods("DELETE")
+		router.HandleFunc(prefix+"/uploads/{id}/finish", withUpload(finishUploadHandler)).Methods("POST")
+	}
+	return router
+}
+
+// newRouter returns a router that does not clean the path of requests, as
+// redirecting would lose the body of uploads. Identifiers in the path are
+// validated by the handlers.
+func newRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.SkipClean(true)
+	return router
+}
+
+// createArchiveHandler streams the archive file of a multipart upload
+// directly to the storage. Requests with a gzip body are handled by
+// rawCreateArchiveHandler, and requests without an archive file by
+// legacyCreateArchiveHandler. Form values used by the upload, like digest,
+// must precede the archive file in the multipart body.
 func createArchiveHandler(w http.ResponseWriter, r *http.Request) {
-	archiveFile, header, err := r.FormFile("archive")
-	if err != nil {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if _, ok := formatOfContentType(mediaType); ok {
+		rawCreateArchiveHandler(w, r)
+		return
+	}
+	if mediaType != "multipart/form-data" {
 		legacyCreateArchiveHandler(w, r)
 		return
 	}
-	if archiveFile == nil {
-		http.Error(w, "archive file is required", http.StatusBadRequest)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	archive, err := NewArchive(archiveFile, header.Filename, baseDir)
+	form := r.URL.Query()
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		if part.FormName() == "archive" && part.FileName() != "" {
+			r.Form = form
+			uploadArchive(w, r, part, part.FileName())
+			return
+		}
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueSize))
+		if err != nil {
+			break
+		}
+		form.Add(part.FormName(), string(value))
+	}
+	r.Form = form
+	legacyCreateArchiveHandler(w, r)
+}
+
+// rawCreateArchiveHandler creates an archive from the raw request body, sent
+// either as PUT /archives/{name} or as a POST with a gzip Content-Type. The
+// body may be sent with a Content-Length or with chunked transfer encoding.
+func rawCreateArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if name == "" {
+		name = r.URL.Query().Get("name")
+	}
+	if name == "" {
+		name = "archive.tar.gz"
+	}
+	if strings.Contains(name, "/") {
+		http.Error(w, "invalid archive name", http.StatusBadRequest)
+		return
+	}
+	uploadArchive(w, r, r.Body, name)
+}
+
+// withUpload adapts a handler of an upload session, identified by the id in
+// the path, to an http.HandlerFunc.
+func withUpload(handler func(http.ResponseWriter, *http.Request, *Upload)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upload, err := GetUpload(mux.Vars(r)["id"])
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		handler(w, r, upload)
+	}
+}
+
+func createUploadHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "archive.tar.gz"
+	}
+	length := int64(-1)
+	if value := r.Header.Get("Upload-Length"); value != "" {
+		var err error
+		length, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || length < 0 {
+			http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+			return
+		}
+	}
+	upload, err := NewUpload(name, length)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	response := map[string]string{"id": archive.ID}
+	writeUploadHeaders(w, upload)
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+upload.ID)
 	w.Header().Add("Content-Type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"id": upload.ID})
+}
+
+func uploadStatusHandler(w http.ResponseWriter, r *http.Request, upload *Upload) {
+	writeUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+func appendUploadHandler(w http.ResponseWriter, r *http.Request, upload *Upload) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	err = upload.Append(offset, r.Body)
+	writeUploadHeaders(w, upload)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func cancelUploadHandler(w http.ResponseWriter, r *http.Request, upload *Upload) {
+	if err := upload.Cancel(); err != nil {
+		uploadError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func finishUploadHandler(w http.ResponseWriter, r *http.Request, upload *Upload) {
+	opts, err := archiveOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store, err := blobStore()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	archive, err := upload.Finish(opts, store)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	writeArchiveCreated(w, archive)
+}
+
+func writeUploadHeaders(w http.ResponseWriter, upload *Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.Length >= 0 {
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func uploadError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case ErrUploadNotFound:
+		status = http.StatusNotFound
+	case ErrUploadOffset, ErrUploadIncomplete:
+		status = http.StatusConflict
+	case ErrUploadTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	}
+	if _, ok := err.(*DigestMismatchError); ok {
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// uploadArchive saves the archive read from body and writes the metadata of
+// the archive in the response.
+func uploadArchive(w http.ResponseWriter, r *http.Request, body io.Reader, name string) {
+	opts, err := archiveOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store, err := blobStore()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	archive, err := NewArchive(body, name, opts, store)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(*DigestMismatchError); ok {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeArchiveCreated(w, archive)
+}
+
+func writeArchiveCreated(w http.ResponseWriter, archive *Archive) {
+	response := map[string]interface{}{
+		"id":     archive.ID,
+		"size":   archive.Size,
+		"digest": archive.Digest,
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -72,7 +439,28 @@ func legacyCreateArchiveHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing archive file", http.StatusBadRequest)
 		return
 	}
-	archive, err := LegacyArchive(path, refid, baseDir, prefix)
+	opts, err := archiveOptions(r)
+	if err == nil {
+		err = pathOptions(r, &opts)
+	}
+	if err == nil {
+		err = opts.format().checkGeneration()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store, err := blobStore()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	archive, err := LegacyArchive(path, refid, prefix, opts, store)
+	if err == ErrQueueFull || err == ErrQueueClosed {
+		w.Header().Set("Retry-After", queueRetryAfter)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -83,12 +471,22 @@ func legacyCreateArchiveHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func readArchiveHandler(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
-	keep := r.URL.Query().Get("keep") == "1"
+// archiveID returns the id of the archive from the path of the request or,
+// in the compatibility routes, from the query string.
+func archiveID(r *http.Request) string {
+	if id := mux.Vars(r)["id"]; id != "" {
+		return id
+	}
+	return r.URL.Query().Get("id")
+}
+
+// requestArchive returns the archive identified in the request, writing the
+// error in the response when it fails.
+func requestArchive(w http.ResponseWriter, r *http.Request) (*Archive, bool) {
+	id := archiveID(r)
 	if id == "" {
 		http.Error(w, "missing archive id", http.StatusBadRequest)
-		return
+		return nil, false
 	}
 	archive, err := GetArchive(id)
 	if err != nil {
@@ -97,11 +495,278 @@ func readArchiveHandler(w http.ResponseWriter, r *http.Request) {
 			status = http.StatusNotFound
 		}
 		http.Error(w, err.Error(), status)
+		return nil, false
+	}
+	return archive, true
+}
+
+// archiveHandler returns the metadata of an archive. With the wait
+// parameter, like wait=30s, the response is delayed until the archive is
+// no longer being built or the given duration expires.
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	archive, ok := requestArchive(w, r)
+	if !ok {
+		return
+	}
+	if value := r.URL.Query().Get("wait"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			http.Error(w, fmt.Sprintf("invalid wait %q", value), http.StatusBadRequest)
+			return
+		}
+		if timeout > maxStatusWait {
+			timeout = maxStatusWait
+		}
+		archive, err = WaitArchive(archive.ID, timeout, r.Context().Done())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeArchive(w, archive, http.StatusOK)
+}
+
+// archiveEventsHandler streams the metadata of an archive as server-sent
+// events: one event with the current state and, when the archive is being
+// built, another once the build finishes.
+func archiveEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	archive, ok := requestArchive(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	sendEvent(w, "status", archiveDocument(archive))
+	flusher.Flush()
+	done := r.Context().Done()
+	for archive.Status == StatusBuilding {
+		next, err := WaitArchive(archive.ID, eventsKeepAlive, done)
+		if err != nil {
+			sendEvent(w, "error", map[string]string{"error": err.Error()})
+			flusher.Flush()
+			return
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if next.Status == StatusBuilding {
+			fmt.Fprint(w, ": keep-alive\n\n")
+		} else {
+			sendEvent(w, "status", archiveDocument(next))
+		}
+		flusher.Flush()
+		archive = next
+	}
+}
+
+func sendEvent(w io.Writer, event string, data interface{}) {
+	content, _ := json.Marshal(data)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, content)
+}
+
+// writeArchive writes the metadata of the archive as a JSON document.
+func writeArchive(w http.ResponseWriter, archive *Archive, status int) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(archiveDocument(archive))
+}
+
+func archiveDocument(archive *Archive) map[string]interface{} {
+	document := map[string]interface{}{
+		"id":            archive.ID,
+		"name":          archive.Name,
+		"status":        archive.Status.String(),
+		"format":        archive.format(),
+		"size":          archive.Size,
+		"digest":        archive.Digest,
+		"log":           archive.Log,
+		"max_downloads": archive.MaxDownloads,
+		"created_at":    archive.CreatedAt,
+		"updated_at":    archive.UpdatedAt,
+	}
+	if !archive.ExpiresAt.IsZero() {
+		document["expires_at"] = archive.ExpiresAt
+	}
+	if archive.Status == StatusBuilding {
+		if position := jobQueue().Position(archive.ID); position > 0 {
+			document["queue_position"] = position
+		}
+	}
+	return document
+}
+
+// archiveContentHandler serves the content of ready archives. While the
+// archive is being built, it responds with 202 Accepted and a Retry-After
+// header, and with 409 Conflict when the build fails. In both cases, the
+// body is the metadata of the archive.
+func archiveContentHandler(w http.ResponseWriter, r *http.Request) {
+	archive, ok := requestArchive(w, r)
+	if !ok {
 		return
 	}
 	switch archive.Status {
 	case StatusReady:
-		serve(w, archive, keep)
+		serve(w, r, archive, r.URL.Query().Get("keep") == "1")
+	case StatusDestroyed:
+		http.Error(w, ErrArchiveNotFound.Error(), http.StatusNotFound)
+	case StatusBuilding:
+		w.Header().Set("Retry-After", buildingRetryAfter)
+		writeArchive(w, archive, http.StatusAccepted)
+	case StatusError:
+		writeArchive(w, archive, http.StatusConflict)
+	default:
+		http.Error(w, "unknown error", http.StatusInternalServerError)
+	}
+}
+
+// deleteArchiveHandler destroys an archive. Destroying an archive that has
+// already been destroyed succeeds.
+func deleteArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	archive, ok := requestArchive(w, r)
+	if !ok {
+		return
+	}
+	if archive.Status != StatusDestroyed {
+		err := DestroyArchive(archive.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listArchivesHandler returns a page of archives, filtered by the status
+// (a comma separated list), name, created_after and created_before (RFC
+// 3339 times) parameters, and sorted by the sort parameter (created_at or
+// -created_at, the default). The next page is requested with the cursor
+// parameter, set to the next field of the response.
+func listArchivesHandler(w http.ResponseWriter, r *http.Request) {
+	query, limit, err := listQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	db, err := archiveStore()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	query.Limit = limit + 1
+	archives, err := db.List(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := map[string]interface{}{}
+	if len(archives) > limit {
+		archives = archives[:limit]
+		response["next"] = archiveCursor(archives[limit-1]).String()
+	}
+	documents := make([]map[string]interface{}, len(archives))
+	for i := range archives {
+		documents[i] = archiveDocument(&archives[i])
+	}
+	response["archives"] = documents
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func listQuery(r *http.Request) (ArchiveQuery, int, error) {
+	values := r.URL.Query()
+	query := ArchiveQuery{Name: values.Get("name"), Descending: true}
+	if value := values.Get("status"); value != "" {
+		for _, name := range strings.Split(value, ",") {
+			status, err := ParseStatus(name)
+			if err != nil {
+				return query, 0, err
+			}
+			query.Status = append(query.Status, status)
+		}
+	}
+	for param, field := range map[string]*time.Time{
+		"created_after":  &query.CreatedAfter,
+		"created_before": &query.CreatedBefore,
+	} {
+		if value := values.Get(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return query, 0, fmt.Errorf("invalid %s %q", param, value)
+			}
+			*field = t
+		}
+	}
+	switch values.Get("sort") {
+	case "", "-created_at":
+	case "created_at":
+		query.Descending = false
+	default:
+		return query, 0, fmt.Errorf("invalid sort %q", values.Get("sort"))
+	}
+	if value := values.Get("cursor"); value != "" {
+		cursor, err := ParseArchiveCursor(value)
+		if err != nil {
+			return query, 0, err
+		}
+		query.After = cursor
+	}
+	limit := defaultListLimit
+	if value := values.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return query, 0, fmt.Errorf("invalid limit %q", value)
+		}
+	}
+	return query, limit, nil
+}
+
+// deleteArchivesHandler destroys the archives that match the name and
+// older_than (like older_than=24h) parameters. At least one of them is
+// required.
+func deleteArchivesHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	var createdBefore time.Time
+	if value := r.URL.Query().Get("older_than"); value != "" {
+		age, err := time.ParseDuration(value)
+		if err != nil || age < 0 {
+			http.Error(w, fmt.Sprintf("invalid older_than %q", value), http.StatusBadRequest)
+			return
+		}
+		createdBefore = time.Now().Add(-age)
+	}
+	if name == "" && createdBefore.IsZero() {
+		http.Error(w, "missing name or older_than", http.StatusBadRequest)
+		return
+	}
+	destroyed, err := DestroyArchives(name, createdBefore)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"destroyed": destroyed})
+}
+
+// readArchiveHandler serves archives in the compatibility route, where
+// archives being built are reported with the BUILDING text.
+func readArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	keep := r.URL.Query().Get("keep") == "1"
+	archive, ok := requestArchive(w, r)
+	if !ok {
+		return
+	}
+	switch archive.Status {
+	case StatusReady:
+		serve(w, r, archive, keep)
 	case StatusDestroyed:
 		http.Error(w, ErrArchiveNotFound.Error(), http.StatusNotFound)
 	case StatusBuilding:
@@ -114,23 +779,416 @@ func readArchiveHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func serve(w http.ResponseWriter, archive *Archive, keep bool) {
-	if !keep {
-		defer func() {
-			err := DestroyArchive(archive.ID)
-			if err != nil {
-				log.Printf("[ERROR] Failed to destroy archive %q: %s", archive.ID, err)
-			}
-		}()
+// serve sends the content of the archive, supporting range and conditional
+// requests. The archive is converted while streaming when it is requested
+// in another format. Unless keep is true, a download is counted once the
+// whole archive has been sent to the client, by one response or by range
+// requests resuming interrupted ones, and the archive is destroyed when it
+// has no downloads left.
+func serve(w http.ResponseWriter, r *http.Request, archive *Archive, keep bool) {
+	format, err := requestFormat(r, archive.format())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !canTranscode(archive.format(), format) {
+		http.Error(w, fmt.Sprintf("archives in %s can't be converted to %s", archive.format(), format), http.StatusNotAcceptable)
+		return
 	}
-	file, err := os.Open(archive.Path)
+	store, err := blobStore()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Vary", "Accept")
+	key := archive.Path
+	if format != archive.format() {
+		key = variantKey(archive, format)
+		if transcodeCache && serveBlob(w, r, store, key, format, "", archive, keep) == nil {
+			return
+		}
+		if err = checkTranscode(archive.format(), format); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveTranscoded(w, r, store, archive, format, keep)
+		return
+	}
+	if err = serveBlob(w, r, store, key, format, archive.Digest, archive, keep); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveBlob serves the content stored in the given key. It returns an
+// error, without writing anything, when the content can't be opened.
+func serveBlob(w http.ResponseWriter, r *http.Request, store BlobStore, key string, format Format, digest string, archive *Archive, keep bool) error {
+	file, err := store.Get(key)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
-	w.Header().Add("Content-Type", "application/x-gzip")
-	io.Copy(w, file)
+	content, err := newServedBlob(file)
+	if err != nil {
+		return err
+	}
+	w.Header().Add("Content-Type", format.ContentType())
+	if digest != "" {
+		w.Header().Set("ETag", `"`+digest+`"`)
+		if sum, err := hex.DecodeString(digest); err == nil {
+			w.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum))
+		}
+	}
+	writer := &trackingWriter{ResponseWriter: w}
+	// The content doesn't change after the archive is created, unlike
+	// UpdatedAt, which changes as downloads are counted.
+	http.ServeContent(writer, r, "", archive.CreatedAt, content)
+	if !keep && r.Method != "HEAD" && downloads.complete(key, content.size, content.sent(writer)) {
+		countDownload(archive)
+	}
+	return nil
+}
+
+// serveTranscoded converts the archive to the given format while sending
+// it. Converted archives are sent without support for range requests and,
+// when the -transcode-cache flag is set, are also saved in the store.
+func serveTranscoded(w http.ResponseWriter, r *http.Request, store BlobStore, archive *Archive, format Format, keep bool) {
+	file, err := store.Get(archive.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", format.ContentType())
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+	writer := &trackingWriter{ResponseWriter: w}
+	var out io.Writer = writer
+	var cached chan error
+	var cache *io.PipeWriter
+	if transcodeCache {
+		var pr *io.PipeReader
+		pr, cache = io.Pipe()
+		cached = make(chan error, 1)
+		go func() {
+			err := store.Put(variantKey(archive, format), pr)
+			pr.Close()
+			cached <- err
+		}()
+		out = &cacheWriter{w: writer, cache: cache}
+	}
+	err = transcode(out, file, archive.format(), format)
+	if cache != nil {
+		cache.CloseWithError(err)
+		if cacheErr := <-cached; err == nil && cacheErr != nil {
+			log.Printf("[ERROR] Failed to cache archive %q in %s: %s", archive.ID, format, cacheErr)
+		}
+	}
+	if err != nil {
+		if writer.err == nil {
+			log.Printf("[ERROR] Failed to convert archive %q to %s: %s", archive.ID, format, err)
+		}
+		// Aborts the response, so the client doesn't take the partial
+		// content as the whole archive.
+		panic(http.ErrAbortHandler)
+	}
+	if !keep {
+		countDownload(archive)
+	}
+}
+
+// cacheWriter writes to w and, until the first failure, to the cache.
+type cacheWriter struct {
+	w      io.Writer
+	cache  io.Writer
+	failed bool
+}
+
+func (c *cacheWriter) Write(p []byte) (int, error) {
+	if !c.failed {
+		_, err := c.cache.Write(p)
+		c.failed = err != nil
+	}
+	return c.w.Write(p)
+}
+
+// countDownload counts a complete download of the archive, destroying the
+// archive when it has no downloads left.
+func countDownload(archive *Archive) {
+	db, err := archiveStore()
+	if err != nil {
+		log.Printf("[ERROR] Failed to count download of archive %q: %s", archive.ID, err)
+		return
+	}
+	left, err := db.DecrementDownloads(archive.ID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to count download of archive %q: %s", archive.ID, err)
+		return
+	}
+	if left > 0 {
+		return
+	}
+	err = DestroyArchive(archive.ID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to destroy archive %q: %s", archive.ID, err)
+	}
+}
+
+// servedBlob tracks the parts of a blob that have been read.
+type servedBlob struct {
+	Blob
+	size   int64
+	offset int64
+	read   [][2]int64
+}
+
+func newServedBlob(blob Blob) (*servedBlob, error) {
+	size, err := blob.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	_, err = blob.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return &servedBlob{Blob: blob, size: size}, nil
+}
+
+func (b *servedBlob) Read(p []byte) (int, error) {
+	n, err := b.Blob.Read(p)
+	if n > 0 {
+		end := b.offset + int64(n)
+		if last := len(b.read) - 1; last >= 0 && b.read[last][1] == b.offset {
+			b.read[last][1] = end
+		} else {
+			b.read = append(b.read, [2]int64{b.offset, end})
+		}
+		b.offset = end
+	}
+	return n, err
+}
+
+func (b *servedBlob) Seek(offset int64, whence int) (int64, error) {
+	offset, err := b.Blob.Seek(offset, whence)
+	b.offset = offset
+	return offset, err
+}
+
+// sent returns the parts of the blob sent to the client. When the response
+// failed, only the bytes written of a response with a single part are known
+// to have been sent.
+func (b *servedBlob) sent(w *trackingWriter) [][2]int64 {
+	if w.err == nil {
+		return b.read
+	}
+	if len(b.read) == 0 || strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/") {
+		return nil
+	}
+	start := b.read[0][0]
+	return [][2]int64{{start, start + w.written}}
+}
+
+// mergeRanges sorts ranges of bytes, merging the ones that overlap or
+// touch.
+func mergeRanges(ranges [][2]int64) [][2]int64 {
+	sorted := append([][2]int64(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i][0] < sorted[j][0] })
+	var merged [][2]int64
+	for _, part := range sorted {
+		if last := len(merged) - 1; last >= 0 && part[0] <= merged[last][1] {
+			if part[1] > merged[last][1] {
+				merged[last][1] = part[1]
+			}
+			continue
+		}
+		merged = append(merged, part)
+	}
+	return merged
+}
+
+// coversRanges returns whether the merged ranges include all the bytes of
+// a blob of the given size. Empty blobs are always covered.
+func coversRanges(merged [][2]int64, size int64) bool {
+	return size == 0 || len(merged) > 0 && merged[0][0] <= 0 && merged[0][1] >= size
+}
+
+// maxPartialDownloads is the number of partial downloads tracked, after
+// which the least recently resumed ones are forgotten.
+const maxPartialDownloads = 10000
+
+// downloads tracks the downloads in progress in this server.
+var downloads = partialDownloads{parts: make(map[string]*partialDownload)}
+
+// partialDownloads keeps the parts of blobs sent by responses that didn't
+// include all of them, so a download interrupted and resumed with range
+// requests is counted once every byte has been sent.
+type partialDownloads struct {
+	mu    sync.Mutex
+	parts map[string]*partialDownload
+}
+
+type partialDownload struct {
+	size    int64
+	sent    [][2]int64
+	updated time.Time
+}
+
+// complete records the parts of the blob in the given key sent by a
+// response, returning whether the blob has been sent completely.
+func (d *partialDownloads) complete(key string, size int64, sent [][2]int64) bool {
+	if coversRanges(mergeRanges(sent), size) {
+		return true
+	}
+	if len(sent) == 0 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	download, ok := d.parts[key]
+	if !ok || download.size != size {
+		if !ok && len(d.parts) >= maxPartialDownloads {
+			d.forgetOldest()
+		}
+		download = &partialDownload{size: size}
+		d.parts[key] = download
+	}
+	download.sent = mergeRanges(append(download.sent, sent...))
+	download.updated = time.Now()
+	if coversRanges(download.sent, size) {
+		delete(d.parts, key)
+		return true
+	}
+	return false
+}
+
+func (d *partialDownloads) forgetOldest() {
+	var oldest string
+	for key, download := range d.parts {
+		if oldest == "" || download.updated.Before(d.parts[oldest].updated) {
+			oldest = key
+		}
+	}
+	delete(d.parts, oldest)
+}
+
+// trackingWriter records the number of bytes written and the first error
+// that happens while writing the response.
+type trackingWriter struct {
+	http.ResponseWriter
+	written int64
+	err     error
+}
+
+func (w *trackingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// archiveOptions returns the options for the creation of an archive, taken
+// from the form values of the request.
+func archiveOptions(r *http.Request) (ArchiveOptions, error) {
+	digest, err := requestDigest(r)
+	if err != nil {
+		return ArchiveOptions{}, err
+	}
+	opts := ArchiveOptions{Digest: digest, MaxDownloads: maxDownloads, TTL: archiveTTL}
+	if value := r.FormValue("max_downloads"); value != "" {
+		opts.MaxDownloads, err = strconv.Atoi(value)
+		if err != nil || opts.MaxDownloads < 1 {
+			return ArchiveOptions{}, fmt.Errorf("invalid max_downloads %q", value)
+		}
+	}
+	if value := r.FormValue("ttl"); value != "" {
+		opts.TTL, err = time.ParseDuration(value)
+		if err != nil || opts.TTL < 0 {
+			return ArchiveOptions{}, fmt.Errorf("invalid ttl %q", value)
+		}
+	}
+	if value := r.FormValue("format"); value != "" {
+		opts.Format, err = ParseFormat(value)
+		if err != nil {
+			return ArchiveOptions{}, err
+		}
+	} else {
+		// Archives sent as the raw body are in the format of their
+		// content type.
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		opts.Format, _ = formatOfContentType(mediaType)
+	}
+	return opts, nil
+}
+
+// pathOptions reads the paths of the repository included in the archive from
+// the paths and exclude form values, which may be repeated or hold
+// comma-separated lists of pathspecs, and the strip form value.
+func pathOptions(r *http.Request, opts *ArchiveOptions) error {
+	opts.Paths = formList(r, "paths")
+	opts.Exclude = formList(r, "exclude")
+	if value := r.FormValue("strip"); value != "" {
+		strip, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid strip %q", value)
+		}
+		opts.Strip = strip
+	}
+	return validatePathspecs(opts.Paths, opts.Exclude, opts.Strip)
+}
+
+func formList(r *http.Request, key string) []string {
+	var list []string
+	for _, value := range r.Form[key] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// requestDigest returns the hex encoded SHA-256 digest that the client
+// expects for the uploaded archive, taken from the digest form value or
+// from the Digest header (RFC 3230). It returns an empty string when the
+// client did not send a digest.
+func requestDigest(r *http.Request) (string, error) {
+	if digest := r.FormValue("digest"); digest != "" {
+		digest = strings.ToLower(strings.TrimPrefix(digest, "sha256:"))
+		if sum, err := hex.DecodeString(digest); err != nil || len(sum) != sha256.Size {
+			return "", fmt.Errorf("invalid digest %q", digest)
+		}
+		return digest, nil
+	}
+	for _, value := range strings.Split(r.Header.Get("Digest"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(value), "=", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "SHA-256") {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(sum) != sha256.Size {
+			return "", fmt.Errorf("invalid digest %q", value)
+		}
+		return hex.EncodeToString(sum), nil
+	}
+	return "", nil
+}
+
+// ensureIndexes creates the indexes of the metadata backend, if it has any.
+func ensureIndexes() {
+	db, err := archiveStore()
+	if err != nil {
+		log.Printf("[ERROR] Failed to open the metadata backend: %s", err)
+		return
+	}
+	if store, ok := db.(MongoStore); ok {
+		if err := store.EnsureIndexes(purgeAfter); err != nil {
+			log.Printf("[ERROR] Failed to create indexes: %s", err)
+		}
+	}
 }
 
 func main() {
@@ -139,20 +1197,33 @@ func main() {
 		fmt.Printf("archive-server version %s\n", version)
 		os.Exit(0)
 	}
+	if flag.Arg(0) == "fsck" {
+		os.Exit(fsck(flag.Args()[1:], os.Stdout))
+	}
 	if readHttp == "" && writeHttp == "" {
 		fmt.Println("You need to specify at-least one of -read-http and -write-http")
 		os.Exit(1)
 	}
+	if err := checkSharedQueue(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	ensureIndexes()
+	go reapArchives(purgeAfter, 10*time.Minute)
+	go reconcileArchives(time.Hour)
 	var wg sync.WaitGroup
-	wg.Add(2)
 	if writeHttp != "" {
+		wg.Add(1)
+		go collectUploads(uploadTTL, time.Hour)
+		go recoverArchives(buildLease)
+		go collectMirrors(mirrorTTL, time.Hour)
 		go func() {
 			log.Printf("[INFO] Starting write server at %q", writeHttp)
 			srv := graceful.Server{
 				Timeout: 10 * time.Minute,
 				Server: &http.Server{
 					Addr:    writeHttp,
-					Handler: http.HandlerFunc(createArchiveHandler),
+					Handler: writeRouter(),
 				},
 			}
 			srv.ListenAndServe()
@@ -160,13 +1231,14 @@ func main() {
 		}()
 	}
 	if readHttp != "" {
+		wg.Add(1)
 		go func() {
 			log.Printf("[INFO] Starting read server at %q", readHttp)
 			srv := graceful.Server{
 				Timeout: 10 * time.Minute,
 				Server: &http.Server{
 					Addr:    readHttp,
-					Handler: http.HandlerFunc(readArchiveHandler),
+					Handler: readRouter(),
 				},
 			}
 			srv.ListenAndServe()
@@ -174,4 +1246,10 @@ func main() {
 		}()
 	}
 	wg.Wait()
+	if writeHttp != "" {
+		log.Printf("[INFO] Waiting for the generation of queued archives")
+		if !jobQueue().Drain(10 * time.Minute) {
+			log.Printf("[ERROR] Stopped before generating all queued archives")
+		}
+	}
 }
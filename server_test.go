@@ -5,19 +5,23 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"gopkg.in/check.v1"
 )
@@ -31,45 +35,337 @@ func Test(t *testing.T) {
 }
 
 func (Suite) SetUpSuite(c *check.C) {
-	databaseAddr = "127.0.0.1:27017"
-	databaseName = "archive_server_test"
+	metadataBackend = "memory"
 	baseDir = "/tmp/archive-server-tests"
+	uploadDir = filepath.Join(baseDir, "uploads")
 	os.MkdirAll(baseDir, 0755)
 	log.SetOutput(ioutil.Discard)
 }
 
 func (Suite) TearDownSuite(c *check.C) {
-	sess, err := conn()
-	c.Assert(err, check.IsNil)
-	sess.Collection("something").Database.DropDatabase()
 	os.RemoveAll(baseDir)
 }
 
-func (Suite) TestConn(c *check.C) {
-	sess, err := conn()
+func (Suite) TestCreateArchiveHandler(c *check.C) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	file, err := writer.CreateFormFile("archive", "app_commit_uuid.tar.gz")
+	c.Assert(err, check.IsNil)
+	file.Write([]byte("hello world!"))
+	writer.Close()
+	request, err := http.NewRequest("POST", "/", strings.NewReader(string(body.Bytes())))
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "multipart/form-data; boundary="+writer.Boundary())
+	recorder := httptest.NewRecorder()
+	createArchiveHandler(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	var m map[string]interface{}
+	err = json.NewDecoder(recorder.Body).Decode(&m)
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	err = sess.Collection("something").Database.Session.Ping()
+	c.Assert(m["size"], check.Equals, float64(12))
+	c.Assert(m["digest"], check.Equals, "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9")
+	archive, err := GetArchive(m["id"].(string))
 	c.Assert(err, check.IsNil)
+	c.Assert(archive.Status, check.Equals, StatusReady)
 }
 
-func (Suite) TestCreateArchiveHandler(c *check.C) {
+func (Suite) TestCreateArchiveHandlerMaxDownloads(c *check.C) {
+	request, err := http.NewRequest("PUT", "/archives/app.tar.gz?max_downloads=3", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	var m map[string]interface{}
+	err = json.NewDecoder(recorder.Body).Decode(&m)
+	c.Assert(err, check.IsNil)
+	archive, err := GetArchive(m["id"].(string))
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.MaxDownloads, check.Equals, 3)
+	request, err = http.NewRequest("PUT", "/archives/app.tar.gz?max_downloads=0", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (Suite) TestCreateArchiveHandlerTTL(c *check.C) {
+	request, err := http.NewRequest("PUT", "/archives/app.tar.gz?ttl=1h", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	var m map[string]interface{}
+	err = json.NewDecoder(recorder.Body).Decode(&m)
+	c.Assert(err, check.IsNil)
+	archive, err := GetArchive(m["id"].(string))
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.ExpiresAt.Sub(archive.CreatedAt), check.Equals, time.Hour)
+	request, err = http.NewRequest("PUT", "/archives/app.tar.gz?ttl=-1h", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (Suite) TestCreateArchiveHandlerFormat(c *check.C) {
+	var tests = []struct {
+		query       string
+		contentType string
+		format      Format
+	}{
+		{"", "", FormatTarGz},
+		{"?format=zip", "", FormatZip},
+		{"?format=tgz", "", FormatTarGz},
+		{"", "application/x-tar", FormatTar},
+		{"?format=tar.xz", "application/x-tar", FormatTarXz},
+	}
+	for _, t := range tests {
+		request, err := http.NewRequest("PUT", "/archives/app"+t.query, strings.NewReader("hello world!"))
+		c.Assert(err, check.IsNil)
+		if t.contentType != "" {
+			request.Header.Set("Content-Type", t.contentType)
+		}
+		recorder := httptest.NewRecorder()
+		writeRouter().ServeHTTP(recorder, request)
+		c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+		var m map[string]interface{}
+		err = json.NewDecoder(recorder.Body).Decode(&m)
+		c.Assert(err, check.IsNil)
+		archive, err := GetArchive(m["id"].(string))
+		c.Assert(err, check.IsNil)
+		c.Check(archive.Format, check.Equals, t.format)
+		c.Check(archive.Path, check.Equals, archive.ID+t.format.Extension())
+	}
+	request, err := http.NewRequest("PUT", "/archives/app?format=rar", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "unsupported format \"rar\"\n")
+}
+
+func (Suite) TestCreateArchiveHandlerDigestMismatch(c *check.C) {
 	var body bytes.Buffer
 	writer := multipart.NewWriter(&body)
+	writer.WriteField("digest", "6ae74cdd206208ac61982d0d9b8b3a72720a5c092b077bf71e08b46e482f14cf")
 	file, err := writer.CreateFormFile("archive", "app_commit_uuid.tar.gz")
 	c.Assert(err, check.IsNil)
 	file.Write([]byte("hello world!"))
 	writer.Close()
-	request, err := http.NewRequest("POST", "/", strings.NewReader(string(body.Bytes())))
+	request, err := http.NewRequest("POST", "/", &body)
 	c.Assert(err, check.IsNil)
 	request.Header.Set("Content-Type", "multipart/form-data; boundary="+writer.Boundary())
 	recorder := httptest.NewRecorder()
 	createArchiveHandler(recorder, request)
-	var m map[string]string
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Matches, "digest mismatch: expected 6ae74cdd.*, got 7509e5bd.*\n")
+}
+
+func (Suite) TestCreateArchiveHandlerLegacyMultipart(c *check.C) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("refid", "e101294022323")
+	writer.Close()
+	request, err := http.NewRequest("POST", "/", &body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "multipart/form-data; boundary="+writer.Boundary())
+	recorder := httptest.NewRecorder()
+	createArchiveHandler(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "missing archive file\n")
+}
+
+func (Suite) TestCreateArchiveHandlerRawPut(c *check.C) {
+	request, err := http.NewRequest("PUT", "/archives/app_commit_uuid.tar.gz", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	var m map[string]interface{}
 	err = json.NewDecoder(recorder.Body).Decode(&m)
 	c.Assert(err, check.IsNil)
-	_, err = GetArchive(m["id"])
+	c.Assert(m["size"], check.Equals, float64(12))
+	archive, err := GetArchive(m["id"].(string))
 	c.Assert(err, check.IsNil)
+	c.Assert(archive.Status, check.Equals, StatusReady)
+	c.Assert(archive.Digest, check.Equals, "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9")
+}
+
+func (Suite) TestCreateArchiveHandlerRawPutInvalidPath(c *check.C) {
+	request, err := http.NewRequest("PUT", "/app.tar.gz", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	request, err = http.NewRequest("PUT", "/archives/some/app.tar.gz", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "invalid archive name\n")
+}
+
+func (Suite) TestCreateArchiveHandlerRawPostChunked(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(createArchiveHandler))
+	defer server.Close()
+	body := io.MultiReader(strings.NewReader("hello "), strings.NewReader("world!"))
+	request, err := http.NewRequest("POST", server.URL+"/?digest=7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9", body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "application/gzip")
+	request.ContentLength = -1
+	response, err := http.DefaultClient.Do(request)
+	c.Assert(err, check.IsNil)
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, check.Equals, http.StatusCreated)
+	var m map[string]interface{}
+	err = json.NewDecoder(response.Body).Decode(&m)
+	c.Assert(err, check.IsNil)
+	c.Assert(m["size"], check.Equals, float64(12))
+	c.Assert(m["digest"], check.Equals, "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9")
+}
+
+func (Suite) TestCreateArchiveHandlerRawPostTruncated(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(createArchiveHandler))
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	c.Assert(err, check.IsNil)
+	fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/gzip\r\nContent-Length: 100\r\n\r\nhello world!")
+	conn.(*net.TCPConn).CloseWrite()
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(response.StatusCode, check.Equals, http.StatusInternalServerError)
+	conn.Close()
+}
+
+func (Suite) TestResumableUpload(c *check.C) {
+	server := httptest.NewServer(writeRouter())
+	defer server.Close()
+	request, err := http.NewRequest("POST", server.URL+"/uploads?name=app.tar.gz", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Upload-Length", "12")
+	response, err := http.DefaultClient.Do(request)
+	c.Assert(err, check.IsNil)
+	response.Body.Close()
+	c.Assert(response.StatusCode, check.Equals, http.StatusCreated)
+	location := response.Header.Get("Location")
+	c.Assert(location, check.Matches, "/uploads/[0-9a-f]+")
+	chunks := []struct {
+		offset string
+		data   string
+		status int
+	}{
+		{"0", "hello ", http.StatusNoContent},
+		{"0", "hello ", http.StatusConflict},
+		{"6", "world!", http.StatusNoContent},
+	}
+	for _, chunk := range chunks {
+		request, err = http.NewRequest("PATCH", server.URL+location, strings.NewReader(chunk.data))
+		c.Assert(err, check.IsNil)
+		request.Header.Set("Upload-Offset", chunk.offset)
+		response, err = http.DefaultClient.Do(request)
+		c.Assert(err, check.IsNil)
+		response.Body.Close()
+		c.Check(response.StatusCode, check.Equals, chunk.status)
+	}
+	response, err = http.Head(server.URL + location)
+	c.Assert(err, check.IsNil)
+	c.Assert(response.StatusCode, check.Equals, http.StatusOK)
+	c.Assert(response.Header.Get("Upload-Offset"), check.Equals, "12")
+	c.Assert(response.Header.Get("Upload-Length"), check.Equals, "12")
+	response, err = http.Post(server.URL+location+"/finish", "", nil)
+	c.Assert(err, check.IsNil)
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, check.Equals, http.StatusCreated)
+	var m map[string]interface{}
+	err = json.NewDecoder(response.Body).Decode(&m)
+	c.Assert(err, check.IsNil)
+	c.Assert(m["digest"], check.Equals, "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9")
+	archive, err := GetArchive(m["id"].(string))
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Status, check.Equals, StatusReady)
+	response, err = http.Head(server.URL + location)
+	c.Assert(err, check.IsNil)
+	c.Assert(response.StatusCode, check.Equals, http.StatusNotFound)
+}
+
+func (Suite) TestResumableUploadIncomplete(c *check.C) {
+	upload, err := NewUpload("app.tar.gz", 12)
+	c.Assert(err, check.IsNil)
+	defer upload.Cancel()
+	request, err := http.NewRequest("POST", "/uploads/"+upload.ID+"/finish", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusConflict)
+	c.Assert(recorder.Body.String(), check.Equals, ErrUploadIncomplete.Error()+"\n")
+}
+
+func (Suite) TestResumableUploadCancel(c *check.C) {
+	upload, err := NewUpload("app.tar.gz", -1)
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("DELETE", "/uploads/"+upload.ID, nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNoContent)
+	_, err = GetUpload(upload.ID)
+	c.Assert(err, check.Equals, ErrUploadNotFound)
+}
+
+func (Suite) TestResumableUploadNotFound(c *check.C) {
+	for _, path := range []string{"/uploads/abc123", "/uploads/../secret", "/uploads/abc/def"} {
+		request, err := http.NewRequest("HEAD", path, nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		writeRouter().ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, http.StatusNotFound)
+	}
+}
+
+func (Suite) TestCreateArchiveHandlerInvalidDigest(c *check.C) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("digest", "abc")
+	file, err := writer.CreateFormFile("archive", "app_commit_uuid.tar.gz")
+	c.Assert(err, check.IsNil)
+	file.Write([]byte("hello world!"))
+	writer.Close()
+	request, err := http.NewRequest("POST", "/", &body)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "multipart/form-data; boundary="+writer.Boundary())
+	recorder := httptest.NewRecorder()
+	createArchiveHandler(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "invalid digest \"abc\"\n")
+}
+
+func (Suite) TestRequestDigest(c *check.C) {
+	var tests = []struct {
+		form     string
+		header   string
+		expected string
+		err      string
+	}{
+		{"", "", "", ""},
+		{"digest=7509E5BDA0C762D2BAC7F90D758B5B2263FA01CCBC542AB5E3DF163BE08E6CA9", "", "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9", ""},
+		{"digest=sha256:7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9", "", "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9", ""},
+		{"digest=7509e5", "", "", `invalid digest "7509e5"`},
+		{"", "MD5=HUXZLQLMuI/KZ5KDcJPcOA==, SHA-256=dQnlvaDHYtK6x/kNdYtbImP6Acy8VCq1498WO+CObKk=", "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9", ""},
+		{"", "MD5=HUXZLQLMuI/KZ5KDcJPcOA==", "", ""},
+		{"", "sha-256=wat", "", `invalid digest "sha-256=wat"`},
+	}
+	for _, t := range tests {
+		request, err := http.NewRequest("POST", "/?"+t.form, nil)
+		c.Assert(err, check.IsNil)
+		request.Header.Set("Digest", t.header)
+		digest, err := requestDigest(request)
+		if t.err != "" {
+			c.Check(err, check.ErrorMatches, t.err)
+		} else {
+			c.Check(err, check.IsNil)
+		}
+		c.Check(digest, check.Equals, t.expected)
+	}
 }
 
 func (Suite) TestCreateArchiveHandlerMissingParams(c *check.C) {
@@ -86,9 +382,9 @@ func (Suite) TestCreateArchiveHandlerMissingParams(c *check.C) {
 }
 
 func (Suite) TestCreateArchiveHandlerArchiveFailure(c *check.C) {
-	oldDbAddr := databaseAddr
-	databaseAddr = "256.256.256.256:27017"
-	defer func() { databaseAddr = oldDbAddr }()
+	oldBackend, oldDbAddr := metadataBackend, databaseAddr
+	metadataBackend, databaseAddr = "mongodb", "256.256.256.256:27017"
+	defer func() { metadataBackend, databaseAddr = oldBackend, oldDbAddr }()
 	var body bytes.Buffer
 	writer := multipart.NewWriter(&body)
 	file, err := writer.CreateFormFile("archive", "app_commit_uuid.tar.gz")
@@ -118,6 +414,71 @@ func (Suite) TestCreateArchiveHandlerLegacy(c *check.C) {
 	c.Assert(err, check.IsNil)
 }
 
+func (Suite) TestCreateArchiveHandlerLegacyPaths(c *check.C) {
+	path, _ := filepath.Abs("testdata/test.git")
+	body := fmt.Sprintf("path=%s&refid=e101294022323&paths=services/api&exclude=services/api/test,*.log&exclude=docs&strip=true", path)
+	request, err := http.NewRequest("POST", "/", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	createArchiveHandler(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusAccepted)
+	var m map[string]string
+	err = json.NewDecoder(recorder.Body).Decode(&m)
+	c.Assert(err, check.IsNil)
+	archive, err := GetArchive(m["id"])
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Source.Paths, check.DeepEquals, []string{"services/api"})
+	c.Assert(archive.Source.Exclude, check.DeepEquals, []string{"services/api/test", "*.log", "docs"})
+	c.Assert(archive.Source.Strip, check.Equals, true)
+	var tests = []struct {
+		query string
+		err   string
+	}{
+		{"paths=../secret", "invalid path \"../secret\"\n"},
+		{"exclude=/etc", "invalid path \"/etc\"\n"},
+		{"paths=a,b&strip=true", "strip requires a single directory in paths\n"},
+		{"paths=a&strip=yes", "invalid strip \"yes\"\n"},
+	}
+	for _, t := range tests {
+		body := fmt.Sprintf("path=%s&refid=e101294022323&%s", path, t.query)
+		request, err := http.NewRequest("POST", "/", strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+		request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		createArchiveHandler(recorder, request)
+		c.Check(recorder.Code, check.Equals, http.StatusBadRequest)
+		c.Check(recorder.Body.String(), check.Equals, t.err)
+	}
+}
+
+func (Suite) TestCreateArchiveHandlerLegacyQueueFull(c *check.C) {
+	defer useIsolatedMetadata(c)()
+	oldQueue := jobQueue()
+	queueMutex.Lock()
+	queue = NewJobQueue(1, 0)
+	queueMutex.Unlock()
+	defer func() {
+		queueMutex.Lock()
+		queue = oldQueue
+		queueMutex.Unlock()
+	}()
+	path, _ := filepath.Abs("testdata/test.git")
+	body := fmt.Sprintf("path=%s&refid=e101294022323&prefix=sproject", path)
+	request, err := http.NewRequest("POST", "/", strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	createArchiveHandler(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(recorder.Header().Get("Retry-After"), check.Equals, queueRetryAfter)
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	archives, err := db.List(ArchiveQuery{})
+	c.Assert(err, check.IsNil)
+	c.Assert(archives, check.HasLen, 0)
+}
+
 func (Suite) TestReadArchiveHandlerStatusReady(c *check.C) {
 	var buf bytes.Buffer
 	testFilePath := "/tmp/archive.tar.gz"
@@ -133,24 +494,281 @@ func (Suite) TestReadArchiveHandlerStatusReady(c *check.C) {
 	src.Close()
 	id := "some interesting id"
 	archive := Archive{ID: id, Path: testFilePath, Status: StatusReady}
-	sess, err := conn()
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	sess.Collection(collectionName).Insert(archive)
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
 	request, err := http.NewRequest("GET", "/?id="+id, nil)
 	c.Assert(err, check.IsNil)
 	recorder := httptest.NewRecorder()
 	readArchiveHandler(recorder, request)
 	c.Assert(recorder.Code, check.Equals, http.StatusOK)
 	c.Assert(recorder.Body.Bytes(), check.DeepEquals, buf.Bytes())
-	err = sess.Collection(collectionName).FindId(id).One(&archive)
+	gotArchive, err := db.Get(id)
 	c.Assert(err, check.IsNil)
-	c.Assert(archive.Status, check.Equals, StatusDestroyed)
+	c.Assert(gotArchive.Status, check.Equals, StatusDestroyed)
 	_, err = os.Stat(testFilePath)
 	c.Assert(os.IsNotExist(err), check.Equals, true)
 }
 
+func (Suite) TestReadArchiveHandlerStatusReadyHeaders(c *check.C) {
+	store := NewLocalStore(baseDir)
+	err := store.Put("headers.tar.gz", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	archive := Archive{
+		ID:     "archive with digest",
+		Path:   "headers.tar.gz",
+		Status: StatusReady,
+		Size:   12,
+		Digest: "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9",
+	}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	request, err := http.NewRequest("GET", "/?id="+archive.ID, nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	readArchiveHandler(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Equals, "hello world!")
+	c.Assert(recorder.Header().Get("Content-Length"), check.Equals, "12")
+	c.Assert(recorder.Header().Get("ETag"), check.Equals, `"`+archive.Digest+`"`)
+	c.Assert(recorder.Header().Get("Digest"), check.Equals, "SHA-256=dQnlvaDHYtK6x/kNdYtbImP6Acy8VCq1498WO+CObKk=")
+}
+
+func (Suite) TestReadArchiveHandlerRange(c *check.C) {
+	store := NewLocalStore(baseDir)
+	err := store.Put("range.tar.gz", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	defer store.Delete("range.tar.gz")
+	archive := Archive{
+		ID:           "archive with ranges",
+		Path:         "range.tar.gz",
+		Status:       StatusReady,
+		Size:         12,
+		Digest:       "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9",
+		MaxDownloads: 2,
+		CreatedAt:    time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC),
+		UpdatedAt:    time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC),
+	}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	var tests = []struct {
+		header string
+		value  string
+		status int
+		body   string
+	}{
+		{"Range", "bytes=0-4", http.StatusPartialContent, "hello"},
+		{"If-None-Match", `"` + archive.Digest + `"`, http.StatusNotModified, ""},
+		{"If-Modified-Since", "Wed, 21 Oct 2015 07:28:00 GMT", http.StatusNotModified, ""},
+		{"Range", "bytes=100-", http.StatusRequestedRangeNotSatisfiable, ""},
+	}
+	for _, t := range tests {
+		request, err := http.NewRequest("GET", "/?id="+archive.ID, nil)
+		c.Assert(err, check.IsNil)
+		request.Header.Set(t.header, t.value)
+		recorder := httptest.NewRecorder()
+		readArchiveHandler(recorder, request)
+		c.Check(recorder.Code, check.Equals, t.status)
+		if t.body != "" {
+			c.Check(recorder.Body.String(), check.Equals, t.body)
+		}
+		if t.status != http.StatusNotModified {
+			c.Check(recorder.Header().Get("Last-Modified"), check.Equals, "Wed, 21 Oct 2015 07:28:00 GMT")
+		}
+		gotArchive, err := db.Get(archive.ID)
+		c.Assert(err, check.IsNil)
+		c.Assert(gotArchive.Status, check.Equals, StatusReady)
+	}
+	// Resuming the download of the first range completes a download.
+	request, err := http.NewRequest("GET", "/?id="+archive.ID, nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Range", "bytes=5-")
+	request.Header.Set("If-Range", `"`+archive.Digest+`"`)
+	recorder := httptest.NewRecorder()
+	readArchiveHandler(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusPartialContent)
+	c.Assert(recorder.Body.String(), check.Equals, " world!")
+	c.Assert(recorder.Header().Get("Content-Range"), check.Equals, "bytes 5-11/12")
+	gotArchive, err := db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(gotArchive.Status, check.Equals, StatusReady)
+	c.Assert(gotArchive.MaxDownloads, check.Equals, 1)
+	request, err = http.NewRequest("GET", "/?id="+archive.ID, nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Range", "bytes=0-")
+	// Counting the download doesn't change the date of the content.
+	request.Header.Set("If-Range", "Wed, 21 Oct 2015 07:28:00 GMT")
+	recorder = httptest.NewRecorder()
+	readArchiveHandler(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusPartialContent)
+	c.Assert(recorder.Body.String(), check.Equals, "hello world!")
+	gotArchive, err = db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(gotArchive.Status, check.Equals, StatusDestroyed)
+}
+
+func (Suite) TestReadArchiveHandlerSuffixRange(c *check.C) {
+	store := NewLocalStore(baseDir)
+	err := store.Put("suffix-range.tar.gz", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	defer store.Delete("suffix-range.tar.gz")
+	archive := Archive{ID: "archive with suffix range", Path: "suffix-range.tar.gz", Status: StatusReady, MaxDownloads: 1}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	for _, value := range []string{"bytes=-1", "bytes=0-0,11-11", "bytes=6-"} {
+		request, err := http.NewRequest("GET", "/?id="+archive.ID, nil)
+		c.Assert(err, check.IsNil)
+		request.Header.Set("Range", value)
+		recorder := httptest.NewRecorder()
+		readArchiveHandler(recorder, request)
+		c.Assert(recorder.Code, check.Equals, http.StatusPartialContent)
+		gotArchive, err := db.Get(archive.ID)
+		c.Assert(err, check.IsNil)
+		c.Assert(gotArchive.Status, check.Equals, StatusReady)
+		c.Assert(gotArchive.MaxDownloads, check.Equals, 1)
+	}
+	_, err = store.Stat(archive.Path)
+	c.Assert(err, check.IsNil)
+}
+
+func (Suite) TestReadArchiveHandlerMaxDownloads(c *check.C) {
+	store := NewLocalStore(baseDir)
+	err := store.Put("max-downloads.tar.gz", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	defer store.Delete("max-downloads.tar.gz")
+	archive := Archive{ID: "archive with downloads", Path: "max-downloads.tar.gz", Status: StatusReady, MaxDownloads: 2}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	for _, status := range []Status{StatusReady, StatusDestroyed} {
+		request, err := http.NewRequest("GET", "/?id="+archive.ID, nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		readArchiveHandler(recorder, request)
+		c.Assert(recorder.Code, check.Equals, http.StatusOK)
+		c.Assert(recorder.Body.String(), check.Equals, "hello world!")
+		gotArchive, err := db.Get(archive.ID)
+		c.Assert(err, check.IsNil)
+		c.Assert(gotArchive.Status, check.Equals, status)
+	}
+}
+
+// partialResponseWriter is a ResponseWriter whose client disconnects after
+// receiving some bytes of the body.
+type partialResponseWriter struct {
+	*httptest.ResponseRecorder
+	left int
+}
+
+func (w *partialResponseWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		n, _ := w.ResponseRecorder.Write(p[:w.left])
+		w.left = 0
+		return n, errors.New("connection reset by peer")
+	}
+	w.left -= len(p)
+	return w.ResponseRecorder.Write(p)
+}
+
+func (Suite) TestReadArchiveHandlerResumedDownload(c *check.C) {
+	store := NewLocalStore(baseDir)
+	err := store.Put("resumed.tar.gz", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	defer store.Delete("resumed.tar.gz")
+	archive := Archive{ID: "resumed archive", Path: "resumed.tar.gz", Status: StatusReady, MaxDownloads: 1}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	request, err := http.NewRequest("GET", "/?id="+archive.ID, nil)
+	c.Assert(err, check.IsNil)
+	writer := &partialResponseWriter{ResponseRecorder: httptest.NewRecorder(), left: 3}
+	readArchiveHandler(writer, request)
+	c.Assert(writer.Body.String(), check.Equals, "hel")
+	gotArchive, err := db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(gotArchive.Status, check.Equals, StatusReady)
+	// Only the bytes received count, so a resume after them is needed.
+	for _, t := range []struct {
+		value  string
+		status Status
+	}{{"bytes=5-", StatusReady}, {"bytes=3-", StatusDestroyed}} {
+		request, err = http.NewRequest("GET", "/?id="+archive.ID, nil)
+		c.Assert(err, check.IsNil)
+		request.Header.Set("Range", t.value)
+		recorder := httptest.NewRecorder()
+		readArchiveHandler(recorder, request)
+		c.Assert(recorder.Code, check.Equals, http.StatusPartialContent)
+		gotArchive, err = db.Get(archive.ID)
+		c.Assert(err, check.IsNil)
+		c.Assert(gotArchive.Status, check.Equals, t.status, check.Commentf("range %s", t.value))
+	}
+}
+
+func (Suite) TestReadArchiveHandlerInterruptedDownload(c *check.C) {
+	store := NewLocalStore(baseDir)
+	err := store.Put("interrupted.tar.gz", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	defer store.Delete("interrupted.tar.gz")
+	archive := Archive{ID: "interrupted archive", Path: "interrupted.tar.gz", Status: StatusReady, MaxDownloads: 1}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	request, err := http.NewRequest("GET", "/?id="+archive.ID, nil)
+	c.Assert(err, check.IsNil)
+	readArchiveHandler(failingResponseWriter{httptest.NewRecorder()}, request)
+	gotArchive, err := db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(gotArchive.Status, check.Equals, StatusReady)
+	c.Assert(gotArchive.MaxDownloads, check.Equals, 1)
+	_, err = store.Stat(archive.Path)
+	c.Assert(err, check.IsNil)
+}
+
+// failingResponseWriter is a ResponseWriter whose client disconnects before
+// receiving the body.
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (failingResponseWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func (Suite) TestReadArchiveHandlerIfRangeMismatch(c *check.C) {
+	store := NewLocalStore(baseDir)
+	err := store.Put("if-range.tar.gz", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	defer store.Delete("if-range.tar.gz")
+	archive := Archive{
+		ID:     "archive with if-range",
+		Path:   "if-range.tar.gz",
+		Status: StatusReady,
+		Digest: "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9",
+	}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	request, err := http.NewRequest("GET", "/?keep=1&id="+archive.ID, nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Range", "bytes=5-")
+	request.Header.Set("If-Range", `"other"`)
+	recorder := httptest.NewRecorder()
+	readArchiveHandler(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Equals, "hello world!")
+}
+
 func (Suite) TestReadArchiveHandlerStatusReadyFileNotfound(c *check.C) {
 	id := "some interesting id"
 	archive := Archive{
@@ -158,11 +776,10 @@ func (Suite) TestReadArchiveHandlerStatusReadyFileNotfound(c *check.C) {
 		Path:   "/tmp/file-that-doesnt-exist-29192.tar.gz",
 		Status: StatusReady,
 	}
-	sess, err := conn()
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	sess.Collection(collectionName).Insert(archive)
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
 	request, err := http.NewRequest("GET", "/?id="+id, nil)
 	c.Assert(err, check.IsNil)
 	recorder := httptest.NewRecorder()
@@ -187,20 +804,19 @@ func (Suite) TestReadArchiveHandlerStatusReadyKeep(c *check.C) {
 	src.Close()
 	id := "some interesting id"
 	archive := Archive{ID: id, Path: testFilePath, Status: StatusReady}
-	sess, err := conn()
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	sess.Collection(collectionName).Insert(archive)
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
 	request, err := http.NewRequest("GET", "/?keep=1&id="+id, nil)
 	c.Assert(err, check.IsNil)
 	recorder := httptest.NewRecorder()
 	readArchiveHandler(recorder, request)
 	c.Assert(recorder.Code, check.Equals, http.StatusOK)
 	c.Assert(recorder.Body.Bytes(), check.DeepEquals, buf.Bytes())
-	err = sess.Collection(collectionName).FindId(id).One(&archive)
+	gotArchive, err := db.Get(id)
 	c.Assert(err, check.IsNil)
-	c.Assert(archive.Status, check.Equals, StatusReady)
+	c.Assert(gotArchive.Status, check.Equals, StatusReady)
 	_, err = os.Stat(testFilePath)
 	c.Assert(err, check.IsNil)
 }
@@ -208,11 +824,10 @@ func (Suite) TestReadArchiveHandlerStatusReadyKeep(c *check.C) {
 func (Suite) TestReadArchiveHandlerStatusDestroyed(c *check.C) {
 	id := "some interesting id"
 	archive := Archive{ID: id, Path: "/tmp/file.tar.gz", Status: StatusDestroyed}
-	sess, err := conn()
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	sess.Collection(collectionName).Insert(archive)
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
 	request, err := http.NewRequest("GET", "/?id="+id, nil)
 	c.Assert(err, check.IsNil)
 	recorder := httptest.NewRecorder()
@@ -224,11 +839,10 @@ func (Suite) TestReadArchiveHandlerStatusDestroyed(c *check.C) {
 func (Suite) TestReadArchiveHandlerStatusBuilding(c *check.C) {
 	id := "some interesting id"
 	archive := Archive{ID: id, Path: "/tmp/file.tar.gz", Status: StatusBuilding}
-	sess, err := conn()
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	sess.Collection(collectionName).Insert(archive)
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
 	request, err := http.NewRequest("GET", "/?id="+id, nil)
 	c.Assert(err, check.IsNil)
 	recorder := httptest.NewRecorder()
@@ -245,11 +859,10 @@ func (Suite) TestReadArchiveHandlerStatusError(c *check.C) {
 		Status: StatusError,
 		Log:    "something went wrong",
 	}
-	sess, err := conn()
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	sess.Collection(collectionName).Insert(archive)
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
 	request, err := http.NewRequest("GET", "/?id="+id, nil)
 	c.Assert(err, check.IsNil)
 	recorder := httptest.NewRecorder()
@@ -261,11 +874,10 @@ func (Suite) TestReadArchiveHandlerStatusError(c *check.C) {
 func (Suite) TestReadArchiveHandlerUnknownStatus(c *check.C) {
 	id := "some interesting id"
 	archive := Archive{ID: id, Path: "/tmp/file.tar.gz", Status: 7}
-	sess, err := conn()
+	db, err := archiveStore()
 	c.Assert(err, check.IsNil)
-	defer sess.Close()
-	sess.Collection(collectionName).Insert(archive)
-	defer sess.Collection(collectionName).RemoveId(archive.ID)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
 	request, err := http.NewRequest("GET", "/?id="+id, nil)
 	c.Assert(err, check.IsNil)
 	recorder := httptest.NewRecorder()
@@ -293,12 +905,479 @@ func (Suite) TestReadArchiveHandlerNotFound(c *check.C) {
 }
 
 func (Suite) TestReadArchiveHandlerDBFailure(c *check.C) {
-	oldDbAddr := databaseAddr
-	databaseAddr = "256.256.256.256:27017"
-	defer func() { databaseAddr = oldDbAddr }()
+	oldBackend, oldDbAddr := metadataBackend, databaseAddr
+	metadataBackend, databaseAddr = "mongodb", "256.256.256.256:27017"
+	defer func() { metadataBackend, databaseAddr = oldBackend, oldDbAddr }()
 	request, err := http.NewRequest("GET", "/?id=somethingnotfound", nil)
 	c.Assert(err, check.IsNil)
 	recorder := httptest.NewRecorder()
 	readArchiveHandler(recorder, request)
 	c.Assert(recorder.Code, check.Equals, http.StatusInternalServerError)
 }
+
+func (Suite) TestReadRouter(c *check.C) {
+	store := NewLocalStore(baseDir)
+	err := store.Put("router.tar.gz", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	defer store.Delete("router.tar.gz")
+	archive := Archive{ID: "archiveinrouter", Path: "router.tar.gz", Status: StatusReady, MaxDownloads: 1}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	var tests = []struct {
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{"POST", "/v1/archives/archiveinrouter", http.StatusMethodNotAllowed, ""},
+		{"GET", "/v1/archives/unknown", http.StatusNotFound, "archive not found\n"},
+		{"GET", "/v1/archives/archiveinrouter/content?keep=1", http.StatusOK, "hello world!"},
+		{"GET", "/?keep=1&id=archiveinrouter", http.StatusOK, "hello world!"},
+		{"PUT", "/", http.StatusMethodNotAllowed, ""},
+		{"DELETE", "/v1/archives/archiveinrouter", http.StatusMethodNotAllowed, ""},
+		{"GET", "/v1/archives/archiveinrouter/content", http.StatusOK, "hello world!"},
+		{"GET", "/v1/archives/archiveinrouter/content", http.StatusNotFound, "archive not found\n"},
+	}
+	for _, t := range tests {
+		request, err := http.NewRequest(t.method, t.path, nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		readRouter().ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, t.status, check.Commentf("%s %s", t.method, t.path))
+		c.Check(recorder.Body.String(), check.Equals, t.body, check.Commentf("%s %s", t.method, t.path))
+	}
+	_, err = store.Stat(archive.Path)
+	c.Assert(err, check.Equals, ErrBlobNotFound)
+}
+
+func (Suite) TestWriteRouter(c *check.C) {
+	request, err := http.NewRequest("PUT", "/v1/archives/app.tar.gz", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	request, err = http.NewRequest("POST", "/v1/uploads", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusCreated)
+	c.Assert(recorder.Header().Get("Location"), check.Matches, "/v1/uploads/[0-9a-f]+")
+	request, err = http.NewRequest("PATCH", "/v1/archives", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusMethodNotAllowed)
+}
+
+func (Suite) TestArchiveHandler(c *check.C) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	archive := Archive{
+		ID:           "archive with metadata",
+		Name:         "app.tar.gz",
+		Path:         "metadata.tar.gz",
+		Status:       StatusReady,
+		Size:         12,
+		Digest:       "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9",
+		MaxDownloads: 1,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		ExpiresAt:    now.Add(time.Hour),
+	}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	request, err := http.NewRequest("GET", "/v1/archives/"+archive.ID, nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	readRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var m map[string]interface{}
+	err = json.NewDecoder(recorder.Body).Decode(&m)
+	c.Assert(err, check.IsNil)
+	c.Assert(m, check.DeepEquals, map[string]interface{}{
+		"id":            archive.ID,
+		"name":          "app.tar.gz",
+		"status":        "ready",
+		"format":        "tar.gz",
+		"size":          float64(12),
+		"digest":        archive.Digest,
+		"log":           "",
+		"max_downloads": float64(1),
+		"created_at":    "2015-10-21T07:28:00Z",
+		"updated_at":    "2015-10-21T07:28:00Z",
+		"expires_at":    "2015-10-21T08:28:00Z",
+	})
+}
+
+func (Suite) TestArchiveContentHandlerFormat(c *check.C) {
+	store := NewLocalStore(baseDir)
+	err := store.Put("format.zip", strings.NewReader("hello world!"))
+	c.Assert(err, check.IsNil)
+	defer store.Delete("format.zip")
+	archive := Archive{ID: "archive in zip", Path: "format.zip", Status: StatusReady, Format: FormatZip, MaxDownloads: 2}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	request, err := http.NewRequest("GET", "/v1/archives/"+archive.ID+"/content", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	readRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/zip")
+}
+
+func (Suite) TestArchiveContentHandlerTranscode(c *check.C) {
+	plain, compressed := testTar(c)
+	store := NewLocalStore(baseDir)
+	err := store.Put("transcode.tar.gz", bytes.NewReader(compressed))
+	c.Assert(err, check.IsNil)
+	defer store.Delete("transcode.tar.gz")
+	archive := Archive{ID: "archive to transcode", Path: "transcode.tar.gz", Status: StatusReady, MaxDownloads: 3}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	request, err := http.NewRequest("GET", "/v1/archives/"+archive.ID+"/content?format=tar", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	readRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/x-tar")
+	c.Assert(recorder.Header().Get("Vary"), check.Equals, "Accept")
+	c.Assert(recorder.Body.Bytes(), check.DeepEquals, plain)
+	request, err = http.NewRequest("GET", "/v1/archives/"+archive.ID+"/content", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Accept", "application/zip")
+	recorder = httptest.NewRecorder()
+	readRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/zip")
+	c.Assert(recorder.Body.String(), check.Matches, "PK.*")
+	got, err := db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(got.MaxDownloads, check.Equals, 1)
+	request, err = http.NewRequest("GET", "/v1/archives/"+archive.ID+"/content?format=rar", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	readRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (Suite) TestMissingFormatCommands(c *check.C) {
+	plain, _ := testTar(c)
+	store := NewLocalStore(baseDir)
+	err := store.Put("missing-commands.tar", bytes.NewReader(plain))
+	c.Assert(err, check.IsNil)
+	defer store.Delete("missing-commands.tar")
+	archive := Archive{ID: "archive without commands", Path: "missing-commands.tar", Status: StatusReady, Format: FormatTar}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	defer withoutCommands(c)()
+	request, err := http.NewRequest("GET", "/v1/archives/"+archive.ID+"/content?format=tar.xz", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	readRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "archives in tar.xz are not supported: the xz command is not installed\n")
+	request, err = http.NewRequest("POST", "/?path=testdata/test.git&refid=master&format=tar.zst", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	legacyCreateArchiveHandler(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "archives in tar.zst are not supported: the zstd command is not installed\n")
+}
+
+func (Suite) TestArchiveContentHandlerTranscodeZip(c *check.C) {
+	archive := Archive{ID: "zip to transcode", Path: "transcode.zip", Status: StatusReady, Format: FormatZip}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	request, err := http.NewRequest("GET", "/v1/archives/"+archive.ID+"/content?format=tar", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	readRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotAcceptable)
+	c.Assert(recorder.Body.String(), check.Equals, "archives in zip can't be converted to tar\n")
+}
+
+func (Suite) TestArchiveContentHandlerTranscodeCache(c *check.C) {
+	transcodeCache = true
+	defer func() { transcodeCache = false }()
+	plain, compressed := testTar(c)
+	store := NewLocalStore(baseDir)
+	err := store.Put("cached.tar.gz", bytes.NewReader(compressed))
+	c.Assert(err, check.IsNil)
+	archive := Archive{ID: "archive to cache", Path: "cached.tar.gz", Status: StatusReady, MaxDownloads: 3}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	for i := 0; i < 2; i++ {
+		request, err := http.NewRequest("GET", "/v1/archives/"+archive.ID+"/content?format=tar", nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		readRouter().ServeHTTP(recorder, request)
+		c.Assert(recorder.Code, check.Equals, http.StatusOK)
+		c.Assert(recorder.Body.Bytes(), check.DeepEquals, plain)
+		content, err := ioutil.ReadFile(filepath.Join(baseDir, "cached.tar"))
+		c.Assert(err, check.IsNil)
+		c.Assert(content, check.DeepEquals, plain)
+	}
+	request, err := http.NewRequest("GET", "/v1/archives/"+archive.ID+"/content?format=tar", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Range", "bytes=0-99")
+	recorder := httptest.NewRecorder()
+	readRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusPartialContent)
+	c.Assert(recorder.Body.Bytes(), check.DeepEquals, plain[:100])
+	err = DestroyArchive(archive.ID)
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(filepath.Join(baseDir, "cached.tar"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (Suite) TestArchiveContentHandlerNotReady(c *check.C) {
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	var tests = []struct {
+		archive Archive
+		status  int
+	}{
+		{Archive{ID: "content building", Status: StatusBuilding}, http.StatusAccepted},
+		{Archive{ID: "content error", Status: StatusError, Log: "something went wrong"}, http.StatusConflict},
+	}
+	for _, t := range tests {
+		db.Insert(t.archive)
+		defer db.Delete(t.archive.ID)
+		request, err := http.NewRequest("GET", "/v1/archives/"+t.archive.ID+"/content", nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		readRouter().ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, t.status)
+		var m map[string]interface{}
+		err = json.NewDecoder(recorder.Body).Decode(&m)
+		c.Assert(err, check.IsNil)
+		c.Check(m["status"], check.Equals, t.archive.Status.String())
+		c.Check(m["log"], check.Equals, t.archive.Log)
+	}
+	request, err := http.NewRequest("GET", "/v1/archives/content building/content", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	readRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Header().Get("Retry-After"), check.Equals, "5")
+}
+
+func (Suite) TestArchiveHandlerWait(c *check.C) {
+	archive := Archive{ID: "archive being built", Status: StatusBuilding}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		db.UpdateStatus(archive.ID, StatusReady, "")
+		notifyArchive(archive.ID)
+	}()
+	request, err := http.NewRequest("GET", "/v1/archives/"+archive.ID+"?wait=30s", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	readRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var m map[string]interface{}
+	err = json.NewDecoder(recorder.Body).Decode(&m)
+	c.Assert(err, check.IsNil)
+	c.Assert(m["status"], check.Equals, "ready")
+	request, err = http.NewRequest("GET", "/v1/archives/"+archive.ID+"?wait=soon", nil)
+	c.Assert(err, check.IsNil)
+	recorder = httptest.NewRecorder()
+	readRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (Suite) TestArchiveEventsHandler(c *check.C) {
+	archive := Archive{ID: "archive with events", Status: StatusBuilding}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	server := httptest.NewServer(readRouter())
+	defer server.Close()
+	response, err := http.Get(server.URL + "/v1/archives/" + archive.ID + "/events")
+	c.Assert(err, check.IsNil)
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, check.Equals, http.StatusOK)
+	c.Assert(response.Header.Get("Content-Type"), check.Equals, "text/event-stream")
+	reader := bufio.NewReader(response.Body)
+	event, err := reader.ReadString('\n')
+	c.Assert(err, check.IsNil)
+	c.Assert(event, check.Equals, "event: status\n")
+	data, err := reader.ReadString('\n')
+	c.Assert(err, check.IsNil)
+	c.Assert(data, check.Matches, `data: \{.*"status":"building".*\}\n`)
+	db.UpdateStatus(archive.ID, StatusReady, "")
+	notifyArchive(archive.ID)
+	rest, err := ioutil.ReadAll(reader)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(rest), check.Matches, `(?s)\nevent: status\ndata: \{.*"status":"ready".*\}\n\n`)
+}
+
+func (Suite) TestDeleteArchiveHandler(c *check.C) {
+	archive := Archive{ID: "archive to delete", Path: "delete.tar.gz", Status: StatusReady}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	var tests = []struct {
+		path   string
+		status int
+	}{
+		{"/v1/archives/" + archive.ID, http.StatusNoContent},
+		{"/v1/archives/" + archive.ID, http.StatusNoContent},
+		{"/v1/archives/unknown", http.StatusNotFound},
+	}
+	for _, t := range tests {
+		request, err := http.NewRequest("DELETE", t.path, nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		writeRouter().ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, t.status)
+	}
+	gotArchive, err := db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(gotArchive.Status, check.Equals, StatusDestroyed)
+}
+
+// discardingStore is a blockingStore that reports the deleted keys.
+type discardingStore struct {
+	blockingStore
+	deleted chan string
+}
+
+func (s discardingStore) Delete(key string) error {
+	s.deleted <- key
+	return s.LocalStore.Delete(key)
+}
+
+func (Suite) TestDeleteArchiveHandlerBuilding(c *check.C) {
+	defer useIsolatedMetadata(c)()
+	store := discardingStore{
+		blockingStore: blockingStore{LocalStore: NewLocalStore(baseDir), release: make(chan struct{})},
+		deleted:       make(chan string, 1),
+	}
+	path, _ := filepath.Abs("testdata/test.git")
+	archive, err := LegacyArchive(path, "master", "project", ArchiveOptions{}, store)
+	c.Assert(err, check.IsNil)
+	request, err := http.NewRequest("DELETE", "/v1/archives/"+archive.ID, nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNoContent)
+	close(store.release)
+	select {
+	case key := <-store.deleted:
+		c.Assert(key, check.Equals, archive.Path)
+	case <-time.After(3 * time.Second):
+		c.Fatal("the content of the destroyed archive was not discarded")
+	}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	gotArchive, err := db.Get(archive.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(gotArchive.Status, check.Equals, StatusDestroyed)
+	_, err = os.Stat(filepath.Join(baseDir, archive.Path))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (Suite) TestDeleteArchivesHandler(c *check.C) {
+	archive := Archive{ID: "archive to bulk delete", Name: "bulk.tar.gz", Path: "bulk.tar.gz", Status: StatusReady}
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	db.Insert(archive)
+	defer db.Delete(archive.ID)
+	var tests = []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"", http.StatusBadRequest, "missing name or older_than\n"},
+		{"?older_than=yesterday", http.StatusBadRequest, "invalid older_than \"yesterday\"\n"},
+		{"?name=bulk.tar.gz", http.StatusOK, `{"destroyed":1}` + "\n"},
+		{"?name=bulk.tar.gz", http.StatusOK, `{"destroyed":0}` + "\n"},
+	}
+	for _, t := range tests {
+		request, err := http.NewRequest("DELETE", "/v1/archives"+t.query, nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		writeRouter().ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, t.status)
+		c.Check(recorder.Body.String(), check.Equals, t.body)
+	}
+}
+
+func (Suite) TestListArchivesHandler(c *check.C) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	db, err := archiveStore()
+	c.Assert(err, check.IsNil)
+	for i, status := range []Status{StatusReady, StatusError, StatusReady, StatusReady} {
+		archive := Archive{
+			ID:        fmt.Sprintf("listed archive %d", i),
+			Name:      "listed.tar.gz",
+			Status:    status,
+			CreatedAt: now.Add(time.Duration(i) * time.Minute),
+		}
+		db.Insert(archive)
+		defer db.Delete(archive.ID)
+	}
+	var ids []string
+	cursor := ""
+	for page := 0; page < 3; page++ {
+		request, err := http.NewRequest("GET", "/v1/archives?name=listed.tar.gz&status=ready&limit=2&cursor="+cursor, nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		writeRouter().ServeHTTP(recorder, request)
+		c.Assert(recorder.Code, check.Equals, http.StatusOK)
+		var response struct {
+			Archives []map[string]interface{}
+			Next     string
+		}
+		err = json.NewDecoder(recorder.Body).Decode(&response)
+		c.Assert(err, check.IsNil)
+		for _, archive := range response.Archives {
+			ids = append(ids, archive["id"].(string))
+		}
+		if response.Next == "" {
+			break
+		}
+		cursor = response.Next
+	}
+	c.Assert(ids, check.DeepEquals, []string{"listed archive 3", "listed archive 2", "listed archive 0"})
+	request, err := http.NewRequest("GET", "/v1/archives?name=listed.tar.gz&sort=created_at&created_after=2015-10-21T07:29:00Z&created_before=2015-10-21T07:31:00Z", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	writeRouter().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var response struct{ Archives []map[string]interface{} }
+	err = json.NewDecoder(recorder.Body).Decode(&response)
+	c.Assert(err, check.IsNil)
+	c.Assert(response.Archives, check.HasLen, 2)
+	c.Assert(response.Archives[0]["id"], check.Equals, "listed archive 1")
+	c.Assert(response.Archives[1]["id"], check.Equals, "listed archive 2")
+}
+
+func (Suite) TestListArchivesHandlerInvalidParams(c *check.C) {
+	for _, query := range []string{"status=lost", "created_after=yesterday", "sort=name", "limit=0", "limit=1000", "cursor=!"} {
+		request, err := http.NewRequest("GET", "/v1/archives?"+query, nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		writeRouter().ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, http.StatusBadRequest, check.Commentf(query))
+	}
+}
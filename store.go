@@ -0,0 +1,403 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const collectionName = "archives"
+
+// Error returned when a cursor for the listing of archives is invalid.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ArchiveStore stores the metadata of archives.
+type ArchiveStore interface {
+	// Insert stores a new archive.
+	Insert(archive Archive) error
+
+	// Get returns an archive by its ID, or ErrArchiveNotFound.
+	Get(id string) (*Archive, error)
+
+	// UpdateStatus changes the status and the log of an archive, touching
+	// its UpdatedAt field, and its DestroyedAt field when the archive is
+	// destroyed.
+	UpdateStatus(id string, status Status, log string) error
+
+	// UpdateStatusIf changes the status and the log of an archive like
+	// UpdateStatus, but only while the archive is in the expected status.
+	// It returns false when the archive is not in this status.
+	UpdateStatusIf(id string, expected, status Status, log string) (bool, error)
+
+	// UpdateContent records the size and the SHA-256 digest of the content
+	// of an archive.
+	UpdateContent(id string, size int64, digest string) error
+
+	// DecrementDownloads atomically decrements the number of downloads left
+	// for an archive, returning the new value.
+	DecrementDownloads(id string) (int, error)
+
+	// Heartbeat records that the archive is still being built by the given
+	// owner. It returns ErrArchiveNotFound when the archive is not being
+	// built by the owner.
+	Heartbeat(id, owner string) error
+
+	// Claim atomically takes the ownership of an archive being built whose
+	// last heartbeat (or update, for archives without heartbeats) happened
+	// before the given time. It returns false when the archive is not in
+	// this state, as when another instance claimed it first.
+	Claim(id, owner string, expiredBefore time.Time) (bool, error)
+
+	// List returns the archives that match the query, sorted by creation
+	// time.
+	List(query ArchiveQuery) ([]Archive, error)
+
+	// Delete removes an archive by its ID.
+	Delete(id string) error
+}
+
+// MongoStore is an ArchiveStore backed by a MongoDB collection. Each
+// operation opens its own connection to the database.
+type MongoStore struct{}
+
+func (MongoStore) Insert(archive Archive) error {
+	db, err := conn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Collection(collectionName).Insert(archive)
+}
+
+func (MongoStore) Get(id string) (*Archive, error) {
+	db, err := conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var archive Archive
+	err = db.Collection(collectionName).FindId(id).One(&archive)
+	if err == mgo.ErrNotFound {
+		return nil, ErrArchiveNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &archive, nil
+}
+
+func (MongoStore) UpdateStatus(id string, status Status, log string) error {
+	db, err := conn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	now := time.Now()
+	set := bson.M{"status": status, "log": log, "updatedat": now}
+	if status == StatusDestroyed {
+		set["destroyedat"] = now
+	}
+	err = db.Collection(collectionName).UpdateId(id, bson.M{"$set": set})
+	if err == mgo.ErrNotFound {
+		return ErrArchiveNotFound
+	}
+	return err
+}
+
+func (MongoStore) UpdateStatusIf(id string, expected, status Status, log string) (bool, error) {
+	db, err := conn()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	now := time.Now()
+	set := bson.M{"status": status, "log": log, "updatedat": now}
+	if status == StatusDestroyed {
+		set["destroyedat"] = now
+	}
+	err = db.Collection(collectionName).Update(bson.M{"_id": id, "status": expected}, bson.M{"$set": set})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (MongoStore) UpdateContent(id string, size int64, digest string) error {
+	db, err := conn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	update := bson.M{"$set": bson.M{"size": size, "digest": digest, "updatedat": time.Now()}}
+	err = db.Collection(collectionName).UpdateId(id, update)
+	if err == mgo.ErrNotFound {
+		return ErrArchiveNotFound
+	}
+	return err
+}
+
+func (MongoStore) DecrementDownloads(id string) (int, error) {
+	db, err := conn()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var archive Archive
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"maxdownloads": -1}, "$set": bson.M{"updatedat": time.Now()}},
+		ReturnNew: true,
+	}
+	_, err = db.Collection(collectionName).FindId(id).Apply(change, &archive)
+	if err == mgo.ErrNotFound {
+		return 0, ErrArchiveNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return archive.MaxDownloads, nil
+}
+
+func (MongoStore) Heartbeat(id, owner string) error {
+	db, err := conn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	selector := bson.M{"_id": id, "owner": owner, "status": StatusBuilding}
+	err = db.Collection(collectionName).Update(selector, bson.M{"$set": bson.M{"heartbeat": time.Now()}})
+	if err == mgo.ErrNotFound {
+		return ErrArchiveNotFound
+	}
+	return err
+}
+
+func (MongoStore) Claim(id, owner string, expiredBefore time.Time) (bool, error) {
+	db, err := conn()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	selector := bson.M{
+		"_id":    id,
+		"status": StatusBuilding,
+		"$or": []bson.M{
+			{"heartbeat": bson.M{"$lt": expiredBefore}},
+			{"heartbeat": bson.M{"$exists": false}, "updatedat": bson.M{"$lt": expiredBefore}},
+		},
+	}
+	now := time.Now()
+	update := bson.M{"$set": bson.M{"owner": owner, "heartbeat": now, "updatedat": now}}
+	err = db.Collection(collectionName).Update(selector, update)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (MongoStore) List(query ArchiveQuery) ([]Archive, error) {
+	db, err := conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var archives []Archive
+	sort := []string{"createdat", "_id"}
+	if query.Descending {
+		sort = []string{"-createdat", "-_id"}
+	}
+	err = db.Collection(collectionName).Find(query.selector()).Sort(sort...).Limit(query.Limit).All(&archives)
+	return archives, err
+}
+
+// EnsureIndexes creates the indexes used to filter and sort archives and to
+// claim generation jobs. When
+// destroyedTTL is positive, it also creates a TTL index that purges the
+// records of archives destroyed for longer than destroyedTTL.
+func (MongoStore) EnsureIndexes(destroyedTTL time.Duration) error {
+	db, err := conn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	indexes := []mgo.Index{
+		{Key: []string{"status"}},
+		{Key: []string{"createdat", "_id"}},
+		{Key: []string{"expiresat"}, Sparse: true},
+	}
+	if destroyedTTL > 0 {
+		indexes = append(indexes, mgo.Index{Key: []string{"destroyedat"}, Sparse: true, ExpireAfter: destroyedTTL})
+	}
+	for _, index := range indexes {
+		err = db.Collection(collectionName).EnsureIndex(index)
+		if err != nil {
+			return err
+		}
+	}
+	return db.Collection(jobsCollectionName).EnsureIndexKey("leaseuntil", "createdat")
+}
+
+func (MongoStore) Delete(id string) error {
+	db, err := conn()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = db.Collection(collectionName).RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return ErrArchiveNotFound
+	}
+	return err
+}
+
+// ArchiveQuery filters and paginates the archives returned by List. The zero
+// value matches all archives.
+type ArchiveQuery struct {
+	// Status, when not empty, restricts the archives to the given statuses.
+	Status []Status
+
+	// Name, when not empty, is the name of the archives.
+	Name string
+
+	// CreatedAfter and CreatedBefore, when not zero, restrict the archives
+	// to the ones created at or after CreatedAfter, and before
+	// CreatedBefore.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// ExpiresBefore, when not zero, restricts the archives to the ones that
+	// expire before the given time.
+	ExpiresBefore time.Time
+
+	// Descending sorts the archives from the newest to the oldest.
+	Descending bool
+
+	// After, when not nil, is the position after which archives are
+	// returned, in the order of the query.
+	After *ArchiveCursor
+
+	// Limit, when positive, is the maximum number of archives returned.
+	Limit int
+}
+
+func (q ArchiveQuery) selector() bson.M {
+	var conditions []bson.M
+	if len(q.Status) > 0 {
+		// Slices of bytes are encoded as binary data, so the statuses
+		// are converted to integers.
+		statuses := make([]int, len(q.Status))
+		for i, status := range q.Status {
+			statuses[i] = int(status)
+		}
+		conditions = append(conditions, bson.M{"status": bson.M{"$in": statuses}})
+	}
+	if q.Name != "" {
+		conditions = append(conditions, bson.M{"name": q.Name})
+	}
+	if !q.CreatedAfter.IsZero() {
+		conditions = append(conditions, bson.M{"createdat": bson.M{"$gte": q.CreatedAfter}})
+	}
+	if !q.CreatedBefore.IsZero() {
+		conditions = append(conditions, bson.M{"createdat": bson.M{"$lt": q.CreatedBefore}})
+	}
+	if !q.ExpiresBefore.IsZero() {
+		conditions = append(conditions, bson.M{"expiresat": bson.M{"$lt": q.ExpiresBefore}})
+	}
+	if q.After != nil {
+		op := "$gt"
+		if q.Descending {
+			op = "$lt"
+		}
+		conditions = append(conditions, bson.M{"$or": []bson.M{
+			{"createdat": bson.M{op: q.After.CreatedAt}},
+			{"createdat": q.After.CreatedAt, "_id": bson.M{op: q.After.ID}},
+		}})
+	}
+	if len(conditions) == 0 {
+		return nil
+	}
+	return bson.M{"$and": conditions}
+}
+
+func (q ArchiveQuery) matches(archive Archive) bool {
+	if len(q.Status) > 0 {
+		found := false
+		for _, status := range q.Status {
+			found = found || archive.Status == status
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Name != "" && archive.Name != q.Name {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && archive.CreatedAt.Before(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !archive.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+	if !q.ExpiresBefore.IsZero() && (archive.ExpiresAt.IsZero() || !archive.ExpiresAt.Before(q.ExpiresBefore)) {
+		return false
+	}
+	if q.After != nil {
+		position := archiveCursor(archive)
+		if q.Descending {
+			return position.less(*q.After)
+		}
+		return q.After.less(position)
+	}
+	return true
+}
+
+// ArchiveCursor is a position in the listing of archives, given by the
+// creation time and the ID of the last archive of a page.
+type ArchiveCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// ParseArchiveCursor parses a cursor in the format returned by String.
+func ParseArchiveCursor(value string) (*ArchiveCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	nsec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &ArchiveCursor{CreatedAt: time.Unix(0, nsec).UTC(), ID: parts[1]}, nil
+}
+
+// String returns the cursor encoded as an opaque string.
+func (c ArchiveCursor) String() string {
+	value := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+// archiveCursor returns the position of the archive in the listing.
+func archiveCursor(archive Archive) ArchiveCursor {
+	return ArchiveCursor{CreatedAt: archive.CreatedAt, ID: archive.ID}
+}
+
+// less returns whether the cursor comes before other in ascending order.
+func (c ArchiveCursor) less(other ArchiveCursor) bool {
+	if c.CreatedAt.Equal(other.CreatedAt) {
+		return c.ID < other.ID
+	}
+	return c.CreatedAt.Before(other.CreatedAt)
+}
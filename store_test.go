@@ -0,0 +1,172 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type MongoSuite struct{}
+
+var _ = check.Suite(MongoSuite{})
+
+func (MongoSuite) SetUpSuite(c *check.C) {
+	databaseAddr = "127.0.0.1:27017"
+	databaseName = "archive_server_test"
+	sess, err := conn()
+	if err != nil {
+		c.Skip("MongoDB is not available: " + err.Error())
+	}
+	sess.Close()
+}
+
+func (MongoSuite) TearDownSuite(c *check.C) {
+	sess, err := conn()
+	if err != nil {
+		return
+	}
+	defer sess.Close()
+	sess.Collection("something").Database.DropDatabase()
+}
+
+func (MongoSuite) TestConn(c *check.C) {
+	sess, err := conn()
+	c.Assert(err, check.IsNil)
+	defer sess.Close()
+	err = sess.Collection("something").Database.Session.Ping()
+	c.Assert(err, check.IsNil)
+}
+
+func (MongoSuite) TestMongoStore(c *check.C) {
+	testArchiveStore(c, MongoStore{})
+}
+
+// testArchiveStore checks the behavior that every ArchiveStore must
+// implement.
+func testArchiveStore(c *check.C, store ArchiveStore) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	first := Archive{ID: "first", Name: "first.tar.gz", Path: "first.tar.gz", Status: StatusBuilding, CreatedAt: now, UpdatedAt: now}
+	second := Archive{ID: "second", Path: "second.tar.gz", Status: StatusReady, MaxDownloads: 2, CreatedAt: now.Add(time.Second), UpdatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	err := store.Insert(second)
+	c.Assert(err, check.IsNil)
+	defer store.Delete(second.ID)
+	err = store.Insert(first)
+	c.Assert(err, check.IsNil)
+	defer store.Delete(first.ID)
+	archive, err := store.Get(first.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Path, check.Equals, first.Path)
+	c.Assert(archive.Status, check.Equals, StatusBuilding)
+	c.Assert(archive.CreatedAt.Equal(now), check.Equals, true)
+	_, err = store.Get("unknown")
+	c.Assert(err, check.Equals, ErrArchiveNotFound)
+	claimed, err := store.Claim(first.ID, "other", now)
+	c.Assert(err, check.IsNil)
+	c.Assert(claimed, check.Equals, false)
+	claimed, err = store.Claim(second.ID, "other", now.Add(time.Hour))
+	c.Assert(err, check.IsNil)
+	c.Assert(claimed, check.Equals, false)
+	claimed, err = store.Claim(first.ID, "other", now.Add(time.Millisecond))
+	c.Assert(err, check.IsNil)
+	c.Assert(claimed, check.Equals, true)
+	err = store.Heartbeat(first.ID, "another")
+	c.Assert(err, check.Equals, ErrArchiveNotFound)
+	err = store.Heartbeat(first.ID, "other")
+	c.Assert(err, check.IsNil)
+	archive, err = store.Get(first.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Owner, check.Equals, "other")
+	c.Assert(archive.Heartbeat.IsZero(), check.Equals, false)
+	updated, err := store.UpdateStatusIf(first.ID, StatusReady, StatusDestroyed, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated, check.Equals, false)
+	updated, err = store.UpdateStatusIf("unknown", StatusBuilding, StatusError, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated, check.Equals, false)
+	updated, err = store.UpdateStatusIf(first.ID, StatusBuilding, StatusError, "something went wrong")
+	c.Assert(err, check.IsNil)
+	c.Assert(updated, check.Equals, true)
+	err = store.UpdateStatus(first.ID, StatusError, "something went wrong")
+	c.Assert(err, check.IsNil)
+	archive, err = store.Get(first.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Status, check.Equals, StatusError)
+	c.Assert(archive.Log, check.Equals, "something went wrong")
+	c.Assert(archive.UpdatedAt.After(now), check.Equals, true)
+	err = store.UpdateStatus("unknown", StatusReady, "")
+	c.Assert(err, check.Equals, ErrArchiveNotFound)
+	left, err := store.DecrementDownloads(second.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(left, check.Equals, 1)
+	left, err = store.DecrementDownloads(second.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(left, check.Equals, 0)
+	_, err = store.DecrementDownloads("unknown")
+	c.Assert(err, check.Equals, ErrArchiveNotFound)
+	archives, err := store.List(ArchiveQuery{})
+	c.Assert(err, check.IsNil)
+	c.Assert(archives, check.HasLen, 2)
+	c.Assert(archives[0].ID, check.Equals, first.ID)
+	c.Assert(archives[1].ID, check.Equals, second.ID)
+	var queries = []struct {
+		query    ArchiveQuery
+		expected []string
+	}{
+		{ArchiveQuery{Status: []Status{StatusReady}}, []string{second.ID}},
+		{ArchiveQuery{Status: []Status{StatusReady, StatusError}}, []string{first.ID, second.ID}},
+		{ArchiveQuery{Name: "first.tar.gz"}, []string{first.ID}},
+		{ArchiveQuery{CreatedAfter: now.Add(time.Second)}, []string{second.ID}},
+		{ArchiveQuery{CreatedBefore: now.Add(time.Second)}, []string{first.ID}},
+		{ArchiveQuery{ExpiresBefore: now.Add(2 * time.Hour)}, []string{second.ID}},
+		{ArchiveQuery{ExpiresBefore: now}, nil},
+		{ArchiveQuery{Descending: true}, []string{second.ID, first.ID}},
+		{ArchiveQuery{Descending: true, Limit: 1}, []string{second.ID}},
+		{ArchiveQuery{After: &ArchiveCursor{CreatedAt: now, ID: first.ID}}, []string{second.ID}},
+		{ArchiveQuery{After: &ArchiveCursor{CreatedAt: now.Add(time.Second), ID: second.ID}, Descending: true}, []string{first.ID}},
+	}
+	for _, q := range queries {
+		archives, err = store.List(q.query)
+		c.Assert(err, check.IsNil)
+		var ids []string
+		for _, archive := range archives {
+			ids = append(ids, archive.ID)
+		}
+		c.Check(ids, check.DeepEquals, q.expected, check.Commentf("%#v", q.query))
+	}
+	err = store.UpdateStatus(second.ID, StatusDestroyed, "")
+	c.Assert(err, check.IsNil)
+	archive, err = store.Get(second.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.DestroyedAt.After(now), check.Equals, true)
+	err = store.Delete(second.ID)
+	c.Assert(err, check.IsNil)
+	_, err = store.Get(second.ID)
+	c.Assert(err, check.Equals, ErrArchiveNotFound)
+	err = store.Delete(second.ID)
+	c.Assert(err, check.Equals, ErrArchiveNotFound)
+}
+
+func (Suite) TestArchiveQuerySelector(c *check.C) {
+	c.Assert(ArchiveQuery{}.selector(), check.IsNil)
+	query := ArchiveQuery{Status: []Status{StatusReady}, Name: "app.tar.gz"}
+	c.Assert(query.selector(), check.DeepEquals, bson.M{"$and": []bson.M{
+		{"status": bson.M{"$in": []int{1}}},
+		{"name": "app.tar.gz"},
+	}})
+}
+
+func (Suite) TestArchiveCursor(c *check.C) {
+	cursor := ArchiveCursor{CreatedAt: time.Unix(1445412480, 123456789).UTC(), ID: "some:id"}
+	parsed, err := ParseArchiveCursor(cursor.String())
+	c.Assert(err, check.IsNil)
+	c.Assert(*parsed, check.DeepEquals, cursor)
+	for _, value := range []string{"!", "bm9jb2xvbg", "YWJjOmlk"} {
+		_, err = ParseArchiveCursor(value)
+		c.Check(err, check.Equals, ErrInvalidCursor)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ErrCannotTranscode is returned when an archive can't be converted to the
+// requested format.
+var ErrCannotTranscode = errors.New("archive can't be converted to the requested format")
+
+// canTranscode reports whether archives in the format from can be converted
+// to the format to while streaming. Only tar based archives can be
+// converted, as zip archives must be read from the end.
+func canTranscode(from, to Format) bool {
+	return from == to || from != FormatZip
+}
+
+// requestFormat returns the format in which the archive is requested, taken
+// from the format parameter or from the Accept header. Media types of the
+// Accept header that don't belong to any format are ignored, and the format
+// of the archive is preferred among the acceptable formats.
+func requestFormat(r *http.Request, stored Format) (Format, error) {
+	if value := r.URL.Query().Get("format"); value != "" {
+		return ParseFormat(value)
+	}
+	best, bestQuality := stored, -1.0
+	for _, value := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		format, ok := formatOfContentType(mediaType)
+		if mediaType == "*/*" || mediaType == "application/*" {
+			format, ok = stored, true
+		}
+		if !ok || quality <= 0 {
+			continue
+		}
+		if quality > bestQuality || (quality == bestQuality && format == stored) {
+			best, bestQuality = format, quality
+		}
+	}
+	return best, nil
+}
+
+// variantKey returns the key where the archive converted to the given format
+// is cached.
+func variantKey(archive *Archive, format Format) string {
+	return strings.TrimSuffix(archive.Path, archive.format().Extension()) + format.Extension()
+}
+
+// transcode converts the content of an archive, read from r, from one format
+// to another, writing the result to w.
+func transcode(w io.Writer, r io.Reader, from, to Format) error {
+	if !canTranscode(from, to) {
+		return ErrCannotTranscode
+	}
+	if from == to {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	tr, err := openTar(r, from)
+	if err != nil {
+		return err
+	}
+	err = writeTar(w, tr, to)
+	if closeErr := tr.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// openTar returns the tar stream of content in the given tar based format.
+func openTar(r io.Reader, format Format) (io.ReadCloser, error) {
+	switch format {
+	case FormatTar:
+		return ioutil.NopCloser(r), nil
+	case FormatTarGz:
+		return gzip.NewReader(r)
+	case FormatTarBz2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	}
+	args := formats[format].decompressor
+	if args == nil {
+		return nil, ErrCannotTranscode
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = r
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &commandReader{ReadCloser: stdout, cmd: cmd, stderr: &stderr}, nil
+}
+
+// commandReader reads the output of a command, which is waited for when the
+// reader is closed.
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (r *commandReader) Close() error {
+	r.ReadCloser.Close()
+	if err := r.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(r.stderr.String()))
+	}
+	return nil
+}
+
+// writeTar writes the tar stream read from r in the given format.
+func writeTar(w io.Writer, r io.Reader, format Format) error {
+	switch format {
+	case FormatTar:
+		_, err := io.Copy(w, r)
+		return err
+	case FormatTarGz:
+		gz := gzip.NewWriter(w)
+		_, err := io.Copy(gz, r)
+		if closeErr := gz.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	case FormatZip:
+		return tarToZip(w, r)
+	}
+	args := formats[format].compressor
+	if args == nil {
+		return ErrCannotTranscode
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = r
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// tarToZip writes the regular files, directories and symbolic links of the
+// tar stream read from r as a zip archive.
+func tarToZip(w io.Writer, r io.Reader) error {
+	tr := tar.NewReader(r)
+	zw := zip.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink:
+		default:
+			continue
+		}
+		fh, err := zip.FileInfoHeader(hdr.FileInfo())
+		if err != nil {
+			return err
+		}
+		fh.Name = hdr.Name
+		fh.Modified = hdr.ModTime
+		if hdr.Typeflag == tar.TypeDir {
+			fh.Name = strings.TrimSuffix(fh.Name, "/") + "/"
+		} else {
+			fh.Method = zip.Deflate
+		}
+		fw, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			_, err = io.Copy(fw, tr)
+		case tar.TypeSymlink:
+			_, err = io.WriteString(fw, hdr.Linkname)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
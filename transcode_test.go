@@ -0,0 +1,129 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// testTar returns a tar with a directory, a file and a symbolic link, and
+// the same tar compressed with gzip.
+func testTar(c *check.C) ([]byte, []byte) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	modTime := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	headers := []tar.Header{
+		{Name: "project/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime},
+		{Name: "project/README", Typeflag: tar.TypeReg, Mode: 0644, Size: 12, ModTime: modTime},
+		{Name: "project/LINK", Typeflag: tar.TypeSymlink, Linkname: "README", Mode: 0777, ModTime: modTime},
+	}
+	for _, hdr := range headers {
+		err := tw.WriteHeader(&hdr)
+		c.Assert(err, check.IsNil)
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte("hello world!"))
+		}
+	}
+	c.Assert(tw.Close(), check.IsNil)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(buf.Bytes())
+	c.Assert(gz.Close(), check.IsNil)
+	return buf.Bytes(), compressed.Bytes()
+}
+
+func (Suite) TestRequestFormat(c *check.C) {
+	var tests = []struct {
+		query  string
+		accept string
+		format Format
+		err    string
+	}{
+		{"", "", FormatTarGz, ""},
+		{"", "*/*", FormatTarGz, ""},
+		{"", "application/zip", FormatZip, ""},
+		{"", "text/html, application/x-tar", FormatTar, ""},
+		{"", "application/zip;q=0.5, application/x-gzip", FormatTarGz, ""},
+		{"", "application/zip, */*;q=0.1", FormatZip, ""},
+		{"", "application/zip;q=0", FormatTarGz, ""},
+		{"", "application/zip, application/x-gzip", FormatTarGz, ""},
+		{"?format=tar", "application/zip", FormatTar, ""},
+		{"?format=rar", "", "", `unsupported format "rar"`},
+	}
+	for _, t := range tests {
+		request, err := http.NewRequest("GET", "/v1/archives/something/content"+t.query, nil)
+		c.Assert(err, check.IsNil)
+		request.Header.Set("Accept", t.accept)
+		format, err := requestFormat(request, FormatTarGz)
+		if t.err != "" {
+			c.Check(err, check.ErrorMatches, t.err)
+			continue
+		}
+		c.Check(err, check.IsNil)
+		c.Check(format, check.Equals, t.format, check.Commentf("Accept: %s", t.accept))
+	}
+}
+
+func (Suite) TestTranscode(c *check.C) {
+	plain, compressed := testTar(c)
+	var buf bytes.Buffer
+	err := transcode(&buf, bytes.NewReader(compressed), FormatTarGz, FormatTar)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.Bytes(), check.DeepEquals, plain)
+	buf.Reset()
+	err = transcode(&buf, bytes.NewReader(plain), FormatTar, FormatTarGz)
+	c.Assert(err, check.IsNil)
+	gz, err := gzip.NewReader(&buf)
+	c.Assert(err, check.IsNil)
+	content, err := ioutil.ReadAll(gz)
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.DeepEquals, plain)
+}
+
+func (Suite) TestTranscodeZip(c *check.C) {
+	_, compressed := testTar(c)
+	var buf bytes.Buffer
+	err := transcode(&buf, bytes.NewReader(compressed), FormatTarGz, FormatZip)
+	c.Assert(err, check.IsNil)
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	c.Assert(err, check.IsNil)
+	c.Assert(zr.File, check.HasLen, 3)
+	c.Assert(zr.File[0].Name, check.Equals, "project/")
+	c.Assert(zr.File[0].FileInfo().IsDir(), check.Equals, true)
+	c.Assert(zr.File[1].Name, check.Equals, "project/README")
+	f, err := zr.File[1].Open()
+	c.Assert(err, check.IsNil)
+	content, err := ioutil.ReadAll(f)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "hello world!")
+	c.Assert(zr.File[2].Name, check.Equals, "project/LINK")
+	c.Assert(zr.File[2].Mode().String(), check.Matches, "L.*")
+	err = transcode(&buf, bytes.NewReader(buf.Bytes()), FormatZip, FormatTar)
+	c.Assert(err, check.Equals, ErrCannotTranscode)
+}
+
+func (Suite) TestTranscodeCompressor(c *check.C) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		c.Skip("zstd is not available")
+	}
+	plain, compressed := testTar(c)
+	var zstd, buf bytes.Buffer
+	err := transcode(&zstd, bytes.NewReader(compressed), FormatTarGz, FormatTarZst)
+	c.Assert(err, check.IsNil)
+	err = transcode(&buf, &zstd, FormatTarZst, FormatTar)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.Bytes(), check.DeepEquals, plain)
+	err = transcode(&buf, bytes.NewReader(plain), FormatTarZst, FormatTar)
+	c.Assert(err, check.ErrorMatches, "exit status 1: .*")
+}
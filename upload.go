@@ -0,0 +1,256 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUploadNotFound is returned when an upload session does not exist.
+	ErrUploadNotFound = errors.New("upload not found")
+
+	// ErrUploadOffset is returned when a chunk is sent to an offset that
+	// is not the current offset of the upload.
+	ErrUploadOffset = errors.New("upload offset mismatch")
+
+	// ErrUploadTooLarge is returned when a chunk exceeds the length
+	// declared for the upload.
+	ErrUploadTooLarge = errors.New("upload exceeds the declared length")
+
+	// ErrUploadIncomplete is returned when an upload is finished before
+	// receiving all the content declared for it.
+	ErrUploadIncomplete = errors.New("upload is incomplete")
+)
+
+var validUploadID = regexp.MustCompile(`^[0-9a-f]+$`)
+
+var (
+	uploadLocksMutex sync.Mutex
+	uploadLocks      = make(map[string]*sync.Mutex)
+)
+
+// Upload is a resumable upload session. The content of the upload is sent
+// in chunks and kept in the upload directory until the upload is finished,
+// when the archive is created.
+type Upload struct {
+	ID        string
+	Name      string
+	Length    int64
+	Offset    int64 `json:"-"`
+	CreatedAt time.Time
+}
+
+// NewUpload starts a new upload session for an archive with the given name.
+// length is the total size of the archive, or -1 when it is not known
+// upfront.
+func NewUpload(name string, length int64) (*Upload, error) {
+	upload := Upload{
+		ID:        newID(name),
+		Name:      name,
+		Length:    length,
+		CreatedAt: time.Now(),
+	}
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(uploadDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(upload.path(".part"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	err = ioutil.WriteFile(upload.path(".json"), data, 0644)
+	if err != nil {
+		os.Remove(upload.path(".part"))
+		return nil, err
+	}
+	log.Printf("[INFO] started upload %q", upload.ID)
+	return &upload, nil
+}
+
+// GetUpload returns an upload session by its ID.
+func GetUpload(id string) (*Upload, error) {
+	if !validUploadID.MatchString(id) {
+		return nil, ErrUploadNotFound
+	}
+	upload := Upload{ID: id}
+	data, err := ioutil.ReadFile(upload.path(".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &upload)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(upload.path(".part"))
+	if os.IsNotExist(err) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	upload.Offset = fi.Size()
+	return &upload, nil
+}
+
+func (u *Upload) path(suffix string) string {
+	return filepath.Join(uploadDir, u.ID+suffix)
+}
+
+func (u *Upload) lock() func() {
+	uploadLocksMutex.Lock()
+	l, ok := uploadLocks[u.ID]
+	if !ok {
+		l = new(sync.Mutex)
+		uploadLocks[u.ID] = l
+	}
+	uploadLocksMutex.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// Append writes a chunk of content at the given offset, which must be the
+// current offset of the upload. When the chunk is interrupted, the content
+// received so far is kept, so the client can query the offset and resume
+// from there.
+func (u *Upload) Append(offset int64, r io.Reader) error {
+	defer u.lock()()
+	f, err := os.OpenFile(u.path(".part"), os.O_WRONLY|os.O_APPEND, 0644)
+	if os.IsNotExist(err) {
+		return ErrUploadNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	u.Offset = fi.Size()
+	if offset != u.Offset {
+		return ErrUploadOffset
+	}
+	if u.Length >= 0 {
+		r = io.LimitReader(r, u.Length-u.Offset+1)
+	}
+	n, err := io.Copy(f, r)
+	u.Offset += n
+	if err == nil && u.Length >= 0 && u.Offset > u.Length {
+		f.Truncate(u.Length)
+		u.Offset = u.Length
+		err = ErrUploadTooLarge
+	}
+	if syncErr := f.Sync(); err == nil {
+		err = syncErr
+	}
+	return err
+}
+
+// Finish creates the archive from the content of the upload and removes
+// the upload session.
+func (u *Upload) Finish(opts ArchiveOptions, store BlobStore) (*Archive, error) {
+	defer u.lock()()
+	f, err := os.Open(u.path(".part"))
+	if os.IsNotExist(err) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	u.Offset = fi.Size()
+	if u.Length >= 0 && u.Offset != u.Length {
+		return nil, ErrUploadIncomplete
+	}
+	archive, err := NewArchive(f, u.Name, opts, store)
+	if err != nil {
+		return archive, err
+	}
+	u.remove()
+	log.Printf("[INFO] finished upload %q as archive %q", u.ID, archive.ID)
+	return archive, nil
+}
+
+// Cancel discards the upload session and the content received so far.
+func (u *Upload) Cancel() error {
+	defer u.lock()()
+	return u.remove()
+}
+
+func (u *Upload) remove() error {
+	err := os.Remove(u.path(".part"))
+	if jsonErr := os.Remove(u.path(".json")); err == nil {
+		err = jsonErr
+	}
+	uploadLocksMutex.Lock()
+	delete(uploadLocks, u.ID)
+	uploadLocksMutex.Unlock()
+	if os.IsNotExist(err) {
+		return ErrUploadNotFound
+	}
+	return err
+}
+
+// CollectUploads removes the upload sessions that did not receive any
+// content in the given duration, returning the number of removed sessions.
+func CollectUploads(maxAge time.Duration) (int, error) {
+	entries, err := ioutil.ReadDir(uploadDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	limit := time.Now().Add(-maxAge)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".part") || entry.ModTime().After(limit) {
+			continue
+		}
+		upload := Upload{ID: strings.TrimSuffix(entry.Name(), ".part")}
+		unlock := upload.lock()
+		fi, err := os.Stat(upload.path(".part"))
+		if err == nil && fi.ModTime().Before(limit) {
+			if upload.remove() == nil {
+				removed++
+				log.Printf("[INFO] removed stale upload %q", upload.ID)
+			}
+		}
+		unlock()
+	}
+	return removed, nil
+}
+
+// collectUploads periodically removes stale upload sessions.
+func collectUploads(maxAge, interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := CollectUploads(maxAge); err != nil {
+			log.Printf("[ERROR] Failed to remove stale uploads: %s", err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Globo.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (Suite) TestUpload(c *check.C) {
+	upload, err := NewUpload("app.tar.gz", -1)
+	c.Assert(err, check.IsNil)
+	c.Assert(upload.Offset, check.Equals, int64(0))
+	err = upload.Append(0, strings.NewReader("hello "))
+	c.Assert(err, check.IsNil)
+	c.Assert(upload.Offset, check.Equals, int64(6))
+	upload, err = GetUpload(upload.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(upload.Name, check.Equals, "app.tar.gz")
+	c.Assert(upload.Length, check.Equals, int64(-1))
+	c.Assert(upload.Offset, check.Equals, int64(6))
+	err = upload.Append(0, strings.NewReader("hello "))
+	c.Assert(err, check.Equals, ErrUploadOffset)
+	err = upload.Append(6, strings.NewReader("world!"))
+	c.Assert(err, check.IsNil)
+	archive, err := upload.Finish(ArchiveOptions{}, NewLocalStore(baseDir))
+	c.Assert(err, check.IsNil)
+	c.Assert(archive.Status, check.Equals, StatusReady)
+	c.Assert(archive.Size, check.Equals, int64(12))
+	content, err := ioutil.ReadFile(filepath.Join(baseDir, archive.Path))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "hello world!")
+	_, err = GetUpload(upload.ID)
+	c.Assert(err, check.Equals, ErrUploadNotFound)
+}
+
+func (Suite) TestUploadInterruptedChunk(c *check.C) {
+	upload, err := NewUpload("app.tar.gz", 12)
+	c.Assert(err, check.IsNil)
+	defer upload.Cancel()
+	err = upload.Append(0, io.MultiReader(strings.NewReader("hello"), failingReader{}))
+	c.Assert(err, check.ErrorMatches, "read failure")
+	upload, err = GetUpload(upload.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(upload.Offset, check.Equals, int64(5))
+	err = upload.Append(5, strings.NewReader(" world!"))
+	c.Assert(err, check.IsNil)
+	c.Assert(upload.Offset, check.Equals, int64(12))
+}
+
+func (Suite) TestUploadTooLarge(c *check.C) {
+	upload, err := NewUpload("app.tar.gz", 5)
+	c.Assert(err, check.IsNil)
+	defer upload.Cancel()
+	err = upload.Append(0, strings.NewReader("hello world!"))
+	c.Assert(err, check.Equals, ErrUploadTooLarge)
+	upload, err = GetUpload(upload.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(upload.Offset, check.Equals, int64(5))
+}
+
+func (Suite) TestUploadFinishIncomplete(c *check.C) {
+	upload, err := NewUpload("app.tar.gz", 12)
+	c.Assert(err, check.IsNil)
+	defer upload.Cancel()
+	err = upload.Append(0, strings.NewReader("hello"))
+	c.Assert(err, check.IsNil)
+	_, err = upload.Finish(ArchiveOptions{}, NewLocalStore(baseDir))
+	c.Assert(err, check.Equals, ErrUploadIncomplete)
+}
+
+func (Suite) TestGetUploadInvalidID(c *check.C) {
+	_, err := GetUpload("../../etc/passwd")
+	c.Assert(err, check.Equals, ErrUploadNotFound)
+}
+
+func (Suite) TestCollectUploads(c *check.C) {
+	stale, err := NewUpload("stale.tar.gz", -1)
+	c.Assert(err, check.IsNil)
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(filepath.Join(uploadDir, stale.ID+".part"), old, old)
+	c.Assert(err, check.IsNil)
+	fresh, err := NewUpload("fresh.tar.gz", -1)
+	c.Assert(err, check.IsNil)
+	defer fresh.Cancel()
+	removed, err := CollectUploads(time.Hour)
+	c.Assert(err, check.IsNil)
+	c.Assert(removed, check.Equals, 1)
+	_, err = GetUpload(stale.ID)
+	c.Assert(err, check.Equals, ErrUploadNotFound)
+	_, err = GetUpload(fresh.ID)
+	c.Assert(err, check.IsNil)
+}